@@ -6,8 +6,9 @@ import (
 	"flag"
 	"fmt"
 	"image"
-	"image/color"
 	"log"
+	"os"
+	"time"
 )
 
 import (
@@ -16,73 +17,6 @@ import (
 	"github.com/lxn/win"
 )
 
-var nesPalette = []color.Color{
-	color.RGBA{0x7c, 0x7c, 0x7c, 0xff},
-	color.RGBA{0x00, 0x00, 0xfc, 0xff},
-	color.RGBA{0x00, 0x00, 0xbc, 0xff},
-	color.RGBA{0x44, 0x28, 0xbc, 0xff},
-	color.RGBA{0x94, 0x00, 0x84, 0xff},
-	color.RGBA{0xa8, 0x00, 0x20, 0xff},
-	color.RGBA{0xa8, 0x10, 0x00, 0xff},
-	color.RGBA{0x88, 0x14, 0x00, 0xff},
-	color.RGBA{0x50, 0x30, 0x00, 0xff},
-	color.RGBA{0x00, 0x78, 0x00, 0xff},
-	color.RGBA{0x00, 0x68, 0x00, 0xff},
-	color.RGBA{0x00, 0x58, 0x00, 0xff},
-	color.RGBA{0x00, 0x40, 0x58, 0xff},
-	color.RGBA{0x00, 0x00, 0x00, 0xff},
-	color.RGBA{0x00, 0x00, 0x00, 0xff},
-	color.RGBA{0x00, 0x00, 0x00, 0xff},
-	color.RGBA{0xbc, 0xbc, 0xbc, 0xff},
-	color.RGBA{0x00, 0x78, 0xf8, 0xff},
-	color.RGBA{0x00, 0x58, 0xf8, 0xff},
-	color.RGBA{0x68, 0x44, 0xfc, 0xff},
-	color.RGBA{0xd8, 0x00, 0xcc, 0xff},
-	color.RGBA{0xe4, 0x00, 0x58, 0xff},
-	color.RGBA{0xf8, 0x38, 0x00, 0xff},
-	color.RGBA{0xe4, 0x5c, 0x10, 0xff},
-	color.RGBA{0xac, 0x7c, 0x00, 0xff},
-	color.RGBA{0x00, 0xb8, 0x00, 0xff},
-	color.RGBA{0x00, 0xa8, 0x00, 0xff},
-	color.RGBA{0x00, 0xa8, 0x44, 0xff},
-	color.RGBA{0x00, 0x88, 0x88, 0xff},
-	color.RGBA{0x00, 0x00, 0x00, 0xff},
-	color.RGBA{0x00, 0x00, 0x00, 0xff},
-	color.RGBA{0x00, 0x00, 0x00, 0xff},
-	color.RGBA{0xf8, 0xf8, 0xf8, 0xff},
-	color.RGBA{0x3c, 0xbc, 0xfc, 0xff},
-	color.RGBA{0x68, 0x88, 0xfc, 0xff},
-	color.RGBA{0x98, 0x78, 0xf8, 0xff},
-	color.RGBA{0xf8, 0x78, 0xf8, 0xff},
-	color.RGBA{0xf8, 0x58, 0x98, 0xff},
-	color.RGBA{0xf8, 0x78, 0x58, 0xff},
-	color.RGBA{0xfc, 0xa0, 0x44, 0xff},
-	color.RGBA{0xf8, 0xb8, 0x00, 0xff},
-	color.RGBA{0xb8, 0xf8, 0x18, 0xff},
-	color.RGBA{0x58, 0xd8, 0x54, 0xff},
-	color.RGBA{0x58, 0xf8, 0x98, 0xff},
-	color.RGBA{0x00, 0xe8, 0xd8, 0xff},
-	color.RGBA{0x78, 0x78, 0x78, 0xff},
-	color.RGBA{0x00, 0x00, 0x00, 0xff},
-	color.RGBA{0x00, 0x00, 0x00, 0xff},
-	color.RGBA{0xfc, 0xfc, 0xfc, 0xff},
-	color.RGBA{0xa4, 0xe4, 0xfc, 0xff},
-	color.RGBA{0xb8, 0xb8, 0xf8, 0xff},
-	color.RGBA{0xd8, 0xb8, 0xf8, 0xff},
-	color.RGBA{0xf8, 0xb8, 0xf8, 0xff},
-	color.RGBA{0xf8, 0xa4, 0xc0, 0xff},
-	color.RGBA{0xf0, 0xd0, 0xb0, 0xff},
-	color.RGBA{0xfc, 0xe0, 0xa8, 0xff},
-	color.RGBA{0xf8, 0xd8, 0x78, 0xff},
-	color.RGBA{0xd8, 0xf8, 0x78, 0xff},
-	color.RGBA{0xb8, 0xf8, 0xb8, 0xff},
-	color.RGBA{0xb8, 0xf8, 0xd8, 0xff},
-	color.RGBA{0x00, 0xfc, 0xfc, 0xff},
-	color.RGBA{0xf8, 0xd8, 0xf8, 0xff},
-	color.RGBA{0x00, 0x00, 0x00, 0xff},
-	color.RGBA{0x00, 0x00, 0x00, 0xff},
-}
-
 var gamepadButtonMap = map[walk.Key]nespkg.GamepadButton{
 	walk.KeyH: nespkg.ButtonLeft,
 	walk.KeyJ: nespkg.ButtonDown,
@@ -139,18 +73,17 @@ func makePaintFunc(display *NesDisplay) func(canvas *walk.Canvas, updateBounds w
 }
 
 func createBitmap(display *NesDisplay) (*walk.Bitmap, error) {
+	if display.image != nil {
+		return walk.NewBitmapFromImage(display.image)
+	}
 	r := image.Rectangle{image.Point{0, 0}, image.Point{nespkg.ScreenSizePixX, nespkg.ScreenSizePixY}}
-	im := image.NewPaletted(r, nesPalette)
+	im := image.NewRGBA(r)
 	if display.screen != nil {
-		for y := 0; y < nespkg.ScreenSizePixY; y++ {
-			for x := 0; x < nespkg.ScreenSizePixX; x++ {
-				im.SetColorIndex(x, y, uint8(display.screen[y][x]))
-			}
-		}
+		display.palette.ToRGBA(im, display.screen)
 	} else {
 		for y := 0; y < nespkg.ScreenSizePixY; y++ {
 			for x := 0; x < nespkg.ScreenSizePixX; x++ {
-				im.SetColorIndex(x, y, uint8(y%len(nesPalette)))
+				im.Set(x, y, display.palette.Color(uint16(y%64)))
 			}
 		}
 	}
@@ -204,11 +137,25 @@ func runMyWidget(display *NesDisplay, nes *nespkg.Nes) {
 	mw.Run()
 }
 
+var benchFrames int
+
 func NewConf() *nespkg.Conf {
 	conf := new(nespkg.Conf)
 	flag.BoolVar(&conf.DebugEnable, "d", false, "Enable debug mode")
 	flag.BoolVar(&conf.TraceEnable, "t", false, "Enable instruction trace")
 	flag.BoolVar(&conf.MemTraceEnable, "m", false, "Enable memory trace")
+	flag.StringVar(&conf.TraceLogFile, "tracelog", "", "Write nestest compatible trace log to `file`")
+	flag.StringVar(&conf.TraceRefFile, "traceref", "", "Stop at the first line differing from reference trace `file`")
+	flag.UintVar(&conf.EntryPoint, "e", 0, "Start execution at `address` instead of the reset vector")
+	flag.StringVar(&conf.CdlFile, "cdl", "", "Log code and data usage, merged into and saved to `file`")
+	flag.IntVar(&conf.ProfileFrames, "prof", 0, "Profile the CPU and print a report every `frames` frames")
+	flag.BoolVar(&conf.DotPpu, "dotppu", false, "Use the dot based PPU instead of the scanline renderer")
+	flag.BoolVar(&conf.NoSpriteLimit, "nospritelimit", false, "Draw all sprites on a line instead of the first 8")
+	flag.StringVar(&conf.Region, "region", "", "Force the TV system: `ntsc`, pal or dendy")
+	flag.StringVar(&conf.Palette, "palette", "", "Load the palette from a .pal `file`, or generate one with \"ntsc\"")
+	flag.StringVar(&conf.NtscFilter, "ntsc", "", "Filter the picture like an NTSC TV: `preset` rf, composite, svideo or rgb")
+	flag.StringVar(&conf.Filters, "filter", "", "Post-process the picture with `filters`: crop, scale2x, scale3x, hq2x, hq3x, xbr, scanlines")
+	flag.IntVar(&benchFrames, "bench", 0, "Run `frames` frames unthrottled, print the speed and exit")
 	flag.Parse()
 	fmt.Println("debug: ", conf.DebugEnable)
 	fmt.Println("instruction trace on: ", conf.TraceEnable)
@@ -220,6 +167,7 @@ func main() {
 	conf := NewConf()
 	display := NewNesDisplay()
 	nes := nespkg.NewNes(conf, display)
+	display.palette = nes.Palette()
 	if len(flag.Args()) >= 1 {
 		nespkg.Debug("loading: %s\n", flag.Arg(0))
 		err := nes.LoadRom(flag.Arg(0))
@@ -232,7 +180,31 @@ func main() {
 		return
 	}
 
-	runMyWidget(display, nes)
+	if benchFrames > 0 {
+		bench(nes, benchFrames)
+	} else {
+		runMyWidget(display, nes)
+	}
+
+	if conf.CdlFile != "" {
+		if err := nes.SaveCdl(conf.CdlFile); err != nil {
+			fmt.Println(err)
+		}
+	}
+	nes.Close()
+}
+
+func bench(nes *nespkg.Nes, frames int) {
+	nes.Reset()
+	start := time.Now()
+	insts := nes.RunFrames(frames)
+	elapsed := time.Since(start)
+	fmt.Printf("%d frames, %d instructions in %v\n", frames, insts, elapsed)
+	fmt.Printf("%.1f frames/s, %.0f instructions/s\n",
+		float64(frames)/elapsed.Seconds(), float64(insts)/elapsed.Seconds())
+	if prof := nes.Profiler(); prof != nil {
+		prof.Report(os.Stdout, nespkg.ProfReportTop)
+	}
 }
 
 func myGoRoutine(mcw *MyCustomWidget) {
@@ -258,18 +230,28 @@ func NewMyCustomWidget(parent walk.Container, display *NesDisplay, nes *nespkg.N
 }
 
 type NesDisplay struct {
-	palette []color.Color
-	screen  *[nespkg.ScreenSizePixY][nespkg.ScreenSizePixX]uint8
+	palette *nespkg.Palette
+	screen  *[nespkg.ScreenSizePixY][nespkg.ScreenSizePixX]uint16
+	image   *image.RGBA
 	mcw     *MyCustomWidget
 }
 
-func (ns *NesDisplay) Render(screen *[nespkg.ScreenSizePixY][nespkg.ScreenSizePixX]uint8) {
+func (ns *NesDisplay) Render(screen *[nespkg.ScreenSizePixY][nespkg.ScreenSizePixX]uint16) {
 	ns.screen = screen
-	ns.mcw.Invalidate()
+	if ns.mcw != nil {
+		ns.mcw.Invalidate()
+	}
+}
+
+func (ns *NesDisplay) RenderImage(im *image.RGBA) {
+	ns.image = im
+	if ns.mcw != nil {
+		ns.mcw.Invalidate()
+	}
 }
 
 func NewNesDisplay() *NesDisplay {
 	nd := new(NesDisplay)
-	nd.palette = nesPalette
+	nd.palette = nespkg.NewDefaultPalette()
 	return nd
 }
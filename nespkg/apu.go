@@ -12,21 +12,39 @@ const apuRegAddressPulse1A = 0x4000
 const apuRegAddressPulse1B = 0x4001
 const apuRegAddressPulse1C = 0x4002
 const apuRegAddressPulse1D = 0x4003
+const apuRegAddressPulse2A = 0x4004
+const apuRegAddressPulse2B = 0x4005
+const apuRegAddressPulse2C = 0x4006
+const apuRegAddressPulse2D = 0x4007
+const apuRegAddressTriangleA = 0x4008
+const apuRegAddressTriangleB = 0x4009
+const apuRegAddressTriangleC = 0x400a
+const apuRegAddressTriangleD = 0x400b
+const apuRegAddressStatus = 0x4015
+const apuRegAddressFrameCounter = 0x4017
 
 type Apu struct {
-	nes    *Nes
-	clock  int
-	player *oto.Player
-	pulse1 *PulseGen
-	//Pulse2   PulseGen
-	//Triangle TriangleGen
+	nes      *Nes
+	clock    uint64
+	player   *oto.Player
+	pulse1   *PulseGen
+	pulse2   *PulseGen
+	triangle *TriangleGen
 	//Noise    NoiseGen
 	//Dmc      DmcGen
+	frameClock       uint
+	sequencerMode    int
+	interruptInhibit bool
+	interruptFlag    bool
+	// output downsampled to samplingRate by averaging
+	sampleClock uint
+	sampleSum   float64
+	sampleCount int
+	samples     []byte
 }
 
 type PulseGen struct {
 	duty              int
-	envelopeLoop      int
 	lengthCounterHalt bool
 	constantVolume    bool
 	volumeEnvelope    int
@@ -37,18 +55,49 @@ type PulseGen struct {
 	timer             int
 	lengthCounterLoad int
 	lengthCounter     int
-	sequencerMode     int
-	interruptInhibit  bool
-	interruptFlag     bool
+	enabled           bool
+	// pulse 1 negates the sweep change in one's complement
+	onesComplement  bool
+	timerCounter    int
+	sequence        int
+	envelopeStart   bool
+	envelopeDivider int
+	envelopeDecay   int
+	sweepReload     bool
+	sweepDivider    int
+}
+
+type TriangleGen struct {
+	control           bool
+	linearCounterLoad int
+	timer             int
+	lengthCounterLoad int
+	lengthCounter     int
+	enabled           bool
+	linearCounter     int
+	linearReload      bool
+	timerCounter      int
+	sequence          int
 }
 
 const SEQUENCER_MODE_0 = 0
 const SEQUENCER_MODE_1 = 1
 
-func NewPulseGen() *PulseGen {
+var pulseDutyTable = [4][8]int{
+	{0, 1, 0, 0, 0, 0, 0, 0},
+	{0, 1, 1, 0, 0, 0, 0, 0},
+	{0, 1, 1, 1, 1, 0, 0, 0},
+	{1, 0, 0, 1, 1, 1, 1, 1},
+}
+
+var lengthCounterTable = [32]int{
+	10, 254, 20, 2, 40, 4, 80, 6, 160, 8, 60, 10, 14, 12, 26, 14,
+	12, 16, 24, 18, 48, 20, 96, 22, 192, 24, 72, 26, 16, 28, 32, 30,
+}
+
+func NewPulseGen(channel int) *PulseGen {
 	pulse := new(PulseGen)
 	pulse.duty = 0
-	pulse.envelopeLoop = 0
 	pulse.lengthCounterHalt = false
 	pulse.constantVolume = false
 	pulse.volumeEnvelope = 0
@@ -59,23 +108,37 @@ func NewPulseGen() *PulseGen {
 	pulse.timer = 0
 	pulse.lengthCounterLoad = 0
 	pulse.lengthCounter = 0
-	pulse.sequencerMode = 0
-	pulse.interruptInhibit = false
-	pulse.interruptFlag = false
+	pulse.enabled = false
+	pulse.onesComplement = channel == 1
 	return pulse
 }
 
+func NewTriangleGen() *TriangleGen {
+	triangle := new(TriangleGen)
+	triangle.control = false
+	triangle.linearCounterLoad = 0
+	triangle.timer = 0
+	triangle.lengthCounterLoad = 0
+	triangle.lengthCounter = 0
+	triangle.enabled = false
+	return triangle
+}
+
 func NewApu(nes *Nes) *Apu {
 	apu := new(Apu)
 	apu.nes = nes
-	apu.pulse1 = NewPulseGen()
+	apu.pulse1 = NewPulseGen(1)
+	apu.pulse2 = NewPulseGen(2)
+	apu.triangle = NewTriangleGen()
 	apu.clock = 0
+	apu.sequencerMode = SEQUENCER_MODE_0
+	apu.samples = make([]byte, 0, bufferSize)
 
 	player, err := oto.NewPlayer(samplingRate, 1, 1, bufferSize)
 	if err != nil {
 		fmt.Println(err)
 		fmt.Println("Fail to create new player")
-		return nil
+		return apu
 	}
 	apu.player = player
 
@@ -124,84 +187,355 @@ func (pulse *PulseGen) writeApuPulseReg(offset uint16, v uint8) {
 		pulse.sweepPeriod = int((v & 0x070) >> 4)
 		pulse.sweepNegate = v&0x08 != 0
 		pulse.sweepShift = int(v & 0x007)
+		pulse.sweepReload = true
+	case 2:
+		pulse.timer = pulse.timer&0x700 | int(v)
+	case 3:
+		pulse.lengthCounterLoad = int((v & 0x0F8) >> 3)
+		pulse.timer = pulse.timer&0x0ff | int(v&0x007)<<8
+		if pulse.enabled {
+			pulse.lengthCounter = lengthCounterTable[pulse.lengthCounterLoad]
+		}
+		pulse.sequence = 0
+		pulse.envelopeStart = true
+	}
+}
+
+func (pulse *PulseGen) setEnabled(on bool) {
+	pulse.enabled = on
+	if !on {
+		pulse.lengthCounter = 0
+	}
+}
+
+// clockTimer runs every APU cycle, stepping the duty sequencer each time
+// the timer wraps.
+func (pulse *PulseGen) clockTimer() {
+	if pulse.timerCounter == 0 {
+		pulse.timerCounter = pulse.timer
+		pulse.sequence = (pulse.sequence + 1) & 7
+	} else {
+		pulse.timerCounter--
+	}
+}
+
+// clockEnvelope runs on quarter frames. The envelope decays from 15 at
+// the rate of its period, looping when the length counter is halted.
+func (pulse *PulseGen) clockEnvelope() {
+	if pulse.envelopeStart {
+		pulse.envelopeStart = false
+		pulse.envelopeDecay = 15
+		pulse.envelopeDivider = pulse.volumeEnvelope
+		return
+	}
+	if pulse.envelopeDivider > 0 {
+		pulse.envelopeDivider--
+		return
+	}
+	pulse.envelopeDivider = pulse.volumeEnvelope
+	if pulse.envelopeDecay > 0 {
+		pulse.envelopeDecay--
+	} else if pulse.lengthCounterHalt {
+		pulse.envelopeDecay = 15
+	}
+}
+
+// sweepTarget is the period the sweep unit moves towards. It is worked out
+// all the time, whether the sweep is enabled or not, for the muting.
+func (pulse *PulseGen) sweepTarget() int {
+	change := pulse.timer >> uint(pulse.sweepShift)
+	if !pulse.sweepNegate {
+		return pulse.timer + change
+	}
+	if pulse.onesComplement {
+		return pulse.timer - change - 1
+	}
+	return pulse.timer - change
+}
+
+func (pulse *PulseGen) muted() bool {
+	return pulse.timer < 8 || pulse.sweepTarget() > 0x7ff
+}
+
+// clockHalfFrame runs the sweep and the length counter.
+func (pulse *PulseGen) clockHalfFrame() {
+	if pulse.sweepDivider == 0 && pulse.sweepEnable && pulse.sweepShift > 0 && !pulse.muted() {
+		pulse.timer = pulse.sweepTarget()
+	}
+	if pulse.sweepDivider == 0 || pulse.sweepReload {
+		pulse.sweepDivider = pulse.sweepPeriod
+		pulse.sweepReload = false
+	} else {
+		pulse.sweepDivider--
+	}
+
+	if !pulse.lengthCounterHalt && pulse.lengthCounter > 0 {
+		pulse.lengthCounter--
+	}
+}
+
+func (pulse *PulseGen) output() int {
+	if pulseDutyTable[pulse.duty][pulse.sequence] == 0 || pulse.lengthCounter == 0 || pulse.muted() {
+		return 0
+	}
+	if pulse.constantVolume {
+		return pulse.volumeEnvelope
+	}
+	return pulse.envelopeDecay
+}
+
+func (triangle *TriangleGen) readApuTriangleReg(offset uint16) uint8 {
+	v := uint8(0)
+	switch offset {
+	case 0:
+		if triangle.control {
+			v |= 0x80
+		}
+		v |= uint8(triangle.linearCounterLoad)
 	case 2:
-		pulse.timer |= int(v)
+		v |= uint8(triangle.timer)
 	case 3:
-		pulse.lengthCounterLoad |= int((v & 0x0F8) >> 3)
-		pulse.timer |= int((v & 0x007) << 8)
+		v |= uint8(triangle.lengthCounterLoad) << 3
+		v |= uint8(triangle.timer>>8) & 0x07
 	}
+	return v
+}
+
+func (triangle *TriangleGen) writeApuTriangleReg(offset uint16, v uint8) {
+	switch offset {
+	case 0:
+		triangle.control = v&0x80 != 0
+		triangle.linearCounterLoad = int(v & 0x7f)
+	case 2:
+		triangle.timer = triangle.timer&0x700 | int(v)
+	case 3:
+		triangle.lengthCounterLoad = int((v & 0x0F8) >> 3)
+		triangle.timer = triangle.timer&0x0ff | int(v&0x007)<<8
+		if triangle.enabled {
+			triangle.lengthCounter = lengthCounterTable[triangle.lengthCounterLoad]
+		}
+		triangle.linearReload = true
+	}
+}
+
+func (triangle *TriangleGen) setEnabled(on bool) {
+	triangle.enabled = on
+	if !on {
+		triangle.lengthCounter = 0
+	}
+}
+
+// clockTimer runs every CPU cycle. The sequencer only moves while both
+// counters are non-zero, so silencing the triangle leaves it where it was
+// instead of dropping the output to 0. Periods under 2 would play far
+// above hearing; the sequencer holds there too, which keeps games that use
+// them to silence the channel from popping.
+func (triangle *TriangleGen) clockTimer() {
+	if triangle.timerCounter > 0 {
+		triangle.timerCounter--
+		return
+	}
+	triangle.timerCounter = triangle.timer
+	if triangle.linearCounter > 0 && triangle.lengthCounter > 0 && triangle.timer >= 2 {
+		triangle.sequence = (triangle.sequence + 1) & 31
+	}
+}
+
+// clockLinearCounter runs on quarter frames. The control flag keeps the
+// counter reloading.
+func (triangle *TriangleGen) clockLinearCounter() {
+	if triangle.linearReload {
+		triangle.linearCounter = triangle.linearCounterLoad
+	} else if triangle.linearCounter > 0 {
+		triangle.linearCounter--
+	}
+	if !triangle.control {
+		triangle.linearReload = false
+	}
+}
+
+func (triangle *TriangleGen) clockLengthCounter() {
+	if !triangle.control && triangle.lengthCounter > 0 {
+		triangle.lengthCounter--
+	}
+}
+
+// output follows the 32 step sequence 15 down to 0, then 0 up to 15.
+func (triangle *TriangleGen) output() int {
+	if triangle.sequence < 16 {
+		return 15 - triangle.sequence
+	}
+	return triangle.sequence - 16
 }
 
 func (apu *Apu) WriteReg(address uint16, v uint8) {
-	if address >= apuRegAddressPulse1A && address <= apuRegAddressPulse1D {
+	switch {
+	case address >= apuRegAddressPulse1A && address <= apuRegAddressPulse1D:
 		apu.pulse1.writeApuPulseReg(address-apuRegAddressPulse1A, v)
+	case address >= apuRegAddressPulse2A && address <= apuRegAddressPulse2D:
+		apu.pulse2.writeApuPulseReg(address-apuRegAddressPulse2A, v)
+	case address >= apuRegAddressTriangleA && address <= apuRegAddressTriangleD:
+		apu.triangle.writeApuTriangleReg(address-apuRegAddressTriangleA, v)
+	case address == apuRegAddressStatus:
+		apu.pulse1.setEnabled(v&0x01 != 0)
+		apu.pulse2.setEnabled(v&0x02 != 0)
+		apu.triangle.setEnabled(v&0x04 != 0)
+	case address == apuRegAddressFrameCounter:
+		apu.writeFrameCounter(v)
 	}
 }
 
 func (apu *Apu) ReadReg(address uint16) uint8 {
-	if address >= apuRegAddressPulse1A && address <= apuRegAddressPulse1D {
+	switch {
+	case address >= apuRegAddressPulse1A && address <= apuRegAddressPulse1D:
 		return apu.pulse1.readApuPulseReg(address - apuRegAddressPulse1A)
+	case address >= apuRegAddressPulse2A && address <= apuRegAddressPulse2D:
+		return apu.pulse2.readApuPulseReg(address - apuRegAddressPulse2A)
+	case address >= apuRegAddressTriangleA && address <= apuRegAddressTriangleD:
+		return apu.triangle.readApuTriangleReg(address - apuRegAddressTriangleA)
+	case address == apuRegAddressStatus:
+		return apu.readStatus()
 	}
 	return 0
 }
 
-const CpuHz = 1789773
+// readStatus returns which length counters are running and the frame
+// interrupt flag, which the read clears.
+func (apu *Apu) readStatus() uint8 {
+	v := uint8(0)
+	if apu.pulse1.lengthCounter > 0 {
+		v |= 0x01
+	}
+	if apu.pulse2.lengthCounter > 0 {
+		v |= 0x02
+	}
+	if apu.triangle.lengthCounter > 0 {
+		v |= 0x04
+	}
+	if apu.interruptFlag {
+		v |= 0x40
+	}
+	apu.setInterruptFlag(false)
+	return v
+}
 
-func timerToHz(t int) int {
-	return CpuHz / (16 * (t + 1))
+func (apu *Apu) setInterruptFlag(on bool) {
+	apu.interruptFlag = on
+	if on {
+		apu.nes.mem.AssertIrq(IrqSourceApuFrame)
+	} else {
+		apu.nes.mem.ReleaseIrq(IrqSourceApuFrame)
+	}
 }
 
-func (apu *Apu) giveFrameTiming() {
-	apu.clock += bufferSize
-	data := make([]byte, bufferSize)
-	hz := timerToHz(apu.pulse1.timer)
-	rectangleWave(data, apu.pulse1.duty, apu.clock, hz, apu.pulse1.volumeEnvelope)
-	//log.Println(data)
-	apu.player.Write(data)
-}
-
-func rectangleWave(data []byte, duty int, clock int, hz int, level int) {
-	if hz <= 0 {
-		for i := range data {
-			data[i] = 0
-		}
-		return
+// writeFrameCounter restarts the frame sequence. 5-step mode clocks the
+// units right away.
+func (apu *Apu) writeFrameCounter(v uint8) {
+	apu.sequencerMode = SEQUENCER_MODE_0
+	if v&0x80 != 0 {
+		apu.sequencerMode = SEQUENCER_MODE_1
 	}
-	clocksPerPeriod := samplingRate / hz
-	Debug("hz=%d clocksPerPeriod=%d\n", hz, clocksPerPeriod)
-	if clocksPerPeriod == 0 {
-		for i := range data {
-			data[i] = 0
-		}
-		return
+	apu.interruptInhibit = v&0x40 != 0
+	if apu.interruptInhibit {
+		apu.setInterruptFlag(false)
 	}
+	apu.frameClock = 0
+	if apu.sequencerMode == SEQUENCER_MODE_1 {
+		apu.clockQuarterFrame()
+		apu.clockHalfFrame()
+	}
+}
 
-	upclocks := 0
-	reverse := false
-	switch duty {
-	case 0:
-		upclocks = clocksPerPeriod / 8
-	case 1:
-		upclocks = clocksPerPeriod / 4
-	case 2:
-		upclocks = clocksPerPeriod / 2
-	case 3:
-		upclocks = clocksPerPeriod / 4
-		reverse = true
+func (apu *Apu) clockQuarterFrame() {
+	apu.pulse1.clockEnvelope()
+	apu.pulse2.clockEnvelope()
+	apu.triangle.clockLinearCounter()
+}
+
+func (apu *Apu) clockHalfFrame() {
+	apu.pulse1.clockHalfFrame()
+	apu.pulse2.clockHalfFrame()
+	apu.triangle.clockLengthCounter()
+}
+
+// clockFrameCounter steps the frame sequence: quarter frames on every
+// step, half frames on every other one, and in 4-step mode the interrupt
+// at the end.
+func (apu *Apu) clockFrameCounter() {
+	steps := &apu.nes.region.apuFrameSteps
+	apu.frameClock++
+	switch apu.frameClock {
+	case steps[0], steps[2]:
+		apu.clockQuarterFrame()
+	case steps[1]:
+		apu.clockQuarterFrame()
+		apu.clockHalfFrame()
+	case steps[3]:
+		if apu.sequencerMode == SEQUENCER_MODE_0 {
+			apu.clockQuarterFrame()
+			apu.clockHalfFrame()
+			if !apu.interruptInhibit {
+				apu.setInterruptFlag(true)
+			}
+			apu.frameClock = 0
+		}
+	case steps[4]:
+		apu.clockQuarterFrame()
+		apu.clockHalfFrame()
+		apu.frameClock = 0
 	}
+}
+
+// Mixer lookup tables from the nonlinear DAC formulas
+var pulseMixTable [31]float64
+
+// indexed by 3*triangle + 2*noise + dmc
+var tndMixTable [203]float64
 
-	up := 0
-	down := level
-	if reverse {
-		up = level
-		down = 0
+func init() {
+	for n := 1; n < len(pulseMixTable); n++ {
+		pulseMixTable[n] = 95.88 / (8128/float64(n) + 100)
 	}
+	for n := 1; n < len(tndMixTable); n++ {
+		tndMixTable[n] = 163.67 / (24329/float64(n) + 100)
+	}
+}
+
+func (apu *Apu) mix() float64 {
+	return pulseMixTable[apu.pulse1.output()+apu.pulse2.output()] + tndMixTable[3*apu.triangle.output()]
+}
+
+// tick runs the APU for the CPU cycles of an instruction.
+func (apu *Apu) tick(cycles uint) {
+	hz := apu.nes.region.CpuHz
+	for i := uint(0); i < cycles; i++ {
+		apu.clockFrameCounter()
+		apu.triangle.clockTimer()
+		if apu.clock&1 != 0 {
+			apu.pulse1.clockTimer()
+			apu.pulse2.clockTimer()
+		}
+		apu.clock++
 
-	for i := range data {
-		if (clock+i)%clocksPerPeriod < upclocks {
-			data[i] = byte(up)
-		} else {
-			data[i] = byte(down)
+		apu.sampleSum += apu.mix()
+		apu.sampleCount++
+		apu.sampleClock += samplingRate
+		if apu.sampleClock >= hz {
+			apu.sampleClock -= hz
+			if len(apu.samples) < cap(apu.samples) {
+				apu.samples = append(apu.samples, byte(apu.sampleSum/float64(apu.sampleCount)*255))
+			}
+			apu.sampleSum = 0
+			apu.sampleCount = 0
 		}
 	}
 }
+
+// giveFrameTiming hands the samples of the frame to the player.
+func (apu *Apu) giveFrameTiming() {
+	//log.Println(apu.samples)
+	if apu.player != nil {
+		apu.player.Write(apu.samples)
+	}
+	apu.samples = apu.samples[:0]
+}
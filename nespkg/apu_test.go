@@ -0,0 +1,45 @@
+package nespkg
+
+import "testing"
+
+// TestPulseSweep checks the sweep target of both pulse channels, which
+// differ in how they negate the change, and the muting that applies
+// whether the sweep is enabled or not.
+func TestPulseSweep(t *testing.T) {
+	tests := []struct {
+		channel int
+		timer   int
+		shift   int
+		negate  bool
+		enable  bool
+		target  int
+		muted   bool
+	}{
+		{1, 0x100, 1, true, true, 0x7f, false},
+		{2, 0x100, 1, true, true, 0x80, false},
+		{1, 0x100, 1, false, true, 0x180, false},
+		{2, 0x100, 1, false, true, 0x180, false},
+		{1, 0x007, 0, false, false, 0x00e, true},
+		{2, 0x007, 1, true, false, 0x004, true},
+		{1, 0x008, 0, false, false, 0x010, false},
+		{1, 0x600, 1, false, false, 0x900, true},
+		{2, 0x600, 1, false, true, 0x900, true},
+		{2, 0x600, 1, true, false, 0x300, false},
+		{1, 0x7ff, 3, true, false, 0x6ff, false},
+	}
+	for _, tt := range tests {
+		pulse := NewPulseGen(tt.channel)
+		pulse.timer = tt.timer
+		pulse.sweepShift = tt.shift
+		pulse.sweepNegate = tt.negate
+		pulse.sweepEnable = tt.enable
+		if got := pulse.sweepTarget(); got != tt.target {
+			t.Errorf("pulse %d timer $%03X shift %d negate %t: target $%03X, want $%03X",
+				tt.channel, tt.timer, tt.shift, tt.negate, got, tt.target)
+		}
+		if got := pulse.muted(); got != tt.muted {
+			t.Errorf("pulse %d timer $%03X shift %d negate %t sweep %t: muted %t, want %t",
+				tt.channel, tt.timer, tt.shift, tt.negate, tt.enable, got, tt.muted)
+		}
+	}
+}
@@ -0,0 +1,727 @@
+package nespkg
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//
+// 6502 assembler
+//
+// Accepts the syntax GetAsmStr prints, optionally with the leading
+// "XXXX:" address and the '*' marker of unofficial opcodes, plus
+//
+//	label:            defines label at the current address
+//	name = expr       defines a constant
+//	.org expr         sets the current address
+//	.byte expr, ...   emits bytes; "strings" emit their characters
+//	.word expr, ...   emits little-endian words
+//	; comment
+//
+// Expressions take $hex, %binary, decimal and 'c' numbers, labels, '*' for
+// the current address, unary - ~ < (low byte) > (high byte) and the binary
+// operators * / % + - << >> & ^ | with C precedence. Operands known to fit
+// in a byte by then use zero page addressing, except $hhhh literals.
+//
+
+type AsmSegment struct {
+	Org  uint16
+	Code []uint8
+}
+
+type AsmProgram struct {
+	Segments []AsmSegment
+	Labels   map[string]uint16
+}
+
+type asmKey struct {
+	mnemonic   string
+	mode       InstMode
+	unofficial bool
+}
+
+var asmOpcodeTable = map[asmKey]uint8{}
+
+func init() {
+	for opc := range instTable {
+		p := instTable[opc]
+		k := asmKey{p.mnemonic, p.mode, p.unofficial}
+		if _, ok := asmOpcodeTable[k]; !ok {
+			asmOpcodeTable[k] = uint8(opc)
+		}
+	}
+}
+
+func asmLookup(mnemonic string, mode InstMode, unofficial bool) (uint8, bool) {
+	if opc, ok := asmOpcodeTable[asmKey{mnemonic, mode, unofficial}]; ok {
+		return opc, true
+	}
+	opc, ok := asmOpcodeTable[asmKey{mnemonic, mode, !unofficial}]
+	return opc, ok
+}
+
+func asmHasMode(mnemonic string, mode InstMode) bool {
+	_, ok := asmLookup(mnemonic, mode, false)
+	return ok
+}
+
+type asmStmt struct {
+	line       int
+	label      string
+	constName  string
+	directive  string
+	mnemonic   string
+	unofficial bool
+	operand    string
+	args       []string
+	mode       InstMode
+	addr       uint16
+	size       int
+}
+
+type assembler struct {
+	labels map[string]uint16
+	pc     uint16
+	final  bool
+}
+
+// Assemble translates src into machine code starting at org.
+func Assemble(src string, org uint16) (*AsmProgram, error) {
+	as := &assembler{labels: map[string]uint16{}, pc: org}
+
+	var stmts []*asmStmt
+	for i, line := range strings.Split(src, "\n") {
+		st, err := parseAsmLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		if st != nil {
+			st.line = i + 1
+			stmts = append(stmts, st)
+		}
+	}
+
+	// Pass 1: assign addresses. Operands referring to labels not yet
+	// defined are assumed to need absolute addressing.
+	for _, st := range stmts {
+		if err := as.layout(st); err != nil {
+			return nil, fmt.Errorf("line %d: %v", st.line, err)
+		}
+	}
+
+	// Pass 2: emit code with every label known
+	as.final = true
+	prog := &AsmProgram{Labels: as.labels}
+	var seg *AsmSegment
+	for _, st := range stmts {
+		as.pc = st.addr
+		code, err := as.emit(st)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", st.line, err)
+		}
+		if len(code) == 0 {
+			continue
+		}
+		if seg == nil || seg.Org+uint16(len(seg.Code)) != st.addr {
+			prog.Segments = append(prog.Segments, AsmSegment{Org: st.addr})
+			seg = &prog.Segments[len(prog.Segments)-1]
+		}
+		seg.Code = append(seg.Code, code...)
+	}
+	return prog, nil
+}
+
+func parseAsmLine(line string) (*asmStmt, error) {
+	if i := asmCommentIndex(line); i >= 0 {
+		line = line[:i]
+	}
+	line = strings.TrimSpace(line)
+
+	// Address prefix as printed by GetAsmStr
+	if len(line) >= 5 && line[4] == ':' && isAsmAddress(line[:4]) {
+		line = strings.TrimSpace(line[5:])
+	}
+	if line == "" {
+		return nil, nil
+	}
+
+	st := new(asmStmt)
+	if i := strings.Index(line, ":"); i > 0 && isIdentifier(line[:i]) {
+		st.label = line[:i]
+		line = strings.TrimSpace(line[i+1:])
+	}
+	if i := strings.Index(line, "="); i > 0 && isIdentifier(strings.TrimSpace(line[:i])) {
+		st.constName = strings.TrimSpace(line[:i])
+		st.operand = strings.TrimSpace(line[i+1:])
+		return st, nil
+	}
+	if line == "" {
+		return st, nil
+	}
+
+	word := line
+	rest := ""
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		word = line[:i]
+		rest = strings.TrimSpace(line[i+1:])
+	}
+	word = strings.ToLower(word)
+
+	if strings.HasPrefix(word, ".") {
+		st.directive = word
+		args, err := splitAsmArgs(rest)
+		if err != nil {
+			return nil, err
+		}
+		st.args = args
+		return st, nil
+	}
+
+	if strings.HasPrefix(word, "*") {
+		st.unofficial = true
+		word = word[1:]
+	}
+	if !isIdentifier(word) {
+		return nil, fmt.Errorf("syntax error: %s", word)
+	}
+	st.mnemonic = word
+	st.operand = rest
+	return st, nil
+}
+
+func asmCommentIndex(line string) int {
+	quoted := false
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '"':
+			quoted = !quoted
+		case '\'':
+			if !quoted && i+2 < len(line) && line[i+2] == '\'' {
+				i += 2
+			}
+		case ';':
+			if !quoted {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func splitAsmArgs(s string) ([]string, error) {
+	var args []string
+	start := 0
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				args = append(args, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated string")
+	}
+	if last := strings.TrimSpace(s[start:]); last != "" || len(args) > 0 {
+		args = append(args, last)
+	}
+	return args, nil
+}
+
+// isAsmAddress tells a "0200:" address prefix from a label such as
+// "beef:": GetAsmStr prints upper case hex, and labels made of hex
+// letters only are left alone.
+func isAsmAddress(s string) bool {
+	digit := false
+	for _, c := range s {
+		if c >= '0' && c <= '9' {
+			digit = true
+		} else if c < 'A' || c > 'F' {
+			return false
+		}
+	}
+	return digit
+}
+
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		if c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+			i > 0 && c >= '0' && c <= '9' {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+func (as *assembler) define(name string, v uint16) error {
+	if old, ok := as.labels[name]; ok && !as.final && old != v {
+		return fmt.Errorf("label redefined: %s", name)
+	}
+	as.labels[name] = v
+	return nil
+}
+
+func (as *assembler) layout(st *asmStmt) error {
+	if st.label != "" {
+		if err := as.define(st.label, as.pc); err != nil {
+			return err
+		}
+	}
+	st.addr = as.pc
+
+	switch {
+	case st.constName != "":
+		v, known, err := as.eval(st.operand)
+		if err != nil {
+			return err
+		}
+		if !known {
+			return fmt.Errorf("constant must not use forward references: %s", st.constName)
+		}
+		return as.define(st.constName, uint16(v))
+	case st.directive != "":
+		return as.layoutDirective(st)
+	case st.mnemonic != "":
+		mode, err := as.decideMode(st)
+		if err != nil {
+			return err
+		}
+		st.mode = mode
+		st.size = int(modeBytes(mode))
+	}
+	as.pc += uint16(st.size)
+	return nil
+}
+
+func (as *assembler) layoutDirective(st *asmStmt) error {
+	switch st.directive {
+	case ".org":
+		if len(st.args) != 1 {
+			return fmt.Errorf(".org: one address expected")
+		}
+		v, known, err := as.eval(st.args[0])
+		if err != nil {
+			return err
+		}
+		if !known {
+			return fmt.Errorf(".org must not use forward references")
+		}
+		as.pc = uint16(v)
+		st.addr = as.pc
+		if st.label != "" {
+			as.labels[st.label] = as.pc
+		}
+		return nil
+	case ".byte":
+		for _, a := range st.args {
+			if s, ok := asmString(a); ok {
+				st.size += len(s)
+			} else {
+				st.size++
+			}
+		}
+	case ".word":
+		st.size = 2 * len(st.args)
+	default:
+		return fmt.Errorf("unknown directive: %s", st.directive)
+	}
+	as.pc += uint16(st.size)
+	return nil
+}
+
+func asmString(s string) (string, bool) {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		return s[1 : len(s)-1], true
+	}
+	return "", false
+}
+
+func modeBytes(mode InstMode) uint {
+	switch mode {
+	case imp, acc:
+		return 1
+	case abs, abx, aby, ind:
+		return 3
+	}
+	return 2
+}
+
+// splitOperand classifies the operand syntax and returns the expression
+// inside it.
+func splitOperand(opd string) (string, string) {
+	u := strings.ToUpper(strings.ReplaceAll(opd, " ", ""))
+	switch {
+	case u == "":
+		return "imp", ""
+	case u == "A":
+		return "acc", ""
+	case strings.HasPrefix(u, "#"):
+		return "imm", opd[strings.Index(opd, "#")+1:]
+	case strings.HasPrefix(u, "(") && strings.HasSuffix(u, ",X)"):
+		return "inx", trimIndex(opd[strings.Index(opd, "(")+1 : strings.LastIndex(opd, ")")])
+	case strings.HasPrefix(u, "(") && strings.HasSuffix(u, "),Y"):
+		return "iny", opd[strings.Index(opd, "(")+1 : strings.LastIndex(opd, ")")]
+	case strings.HasPrefix(u, "(") && strings.HasSuffix(u, ",Y)"):
+		return "iny", trimIndex(opd[strings.Index(opd, "(")+1 : strings.LastIndex(opd, ")")])
+	case strings.HasPrefix(u, "(") && strings.HasSuffix(u, ")") && matchingParen(u) == len(u)-1:
+		return "ind", opd[strings.Index(opd, "(")+1 : strings.LastIndex(opd, ")")]
+	case strings.HasSuffix(u, ",X"):
+		return "x", trimIndex(opd)
+	case strings.HasSuffix(u, ",Y"):
+		return "y", trimIndex(opd)
+	}
+	return "", opd
+}
+
+func isAsmWordLiteral(s string) bool {
+	s = strings.TrimSpace(s)
+	if len(s) != 5 || s[0] != '$' {
+		return false
+	}
+	_, err := strconv.ParseUint(s[1:], 16, 16)
+	return err == nil
+}
+
+func trimIndex(s string) string {
+	return s[:strings.LastIndex(s, ",")]
+}
+
+func matchingParen(s string) int {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func (as *assembler) decideMode(st *asmStmt) (InstMode, error) {
+	m := st.mnemonic
+	kind, expr := splitOperand(st.operand)
+
+	pick := func(modes ...InstMode) (InstMode, error) {
+		for _, mode := range modes {
+			if asmHasMode(m, mode) {
+				return mode, nil
+			}
+		}
+		return 0, fmt.Errorf("invalid addressing mode: %s %s", m, st.operand)
+	}
+
+	// Zero page forms are used when the value is already known to fit.
+	// Labels defined later keep the absolute form pass 1 gave them, and a
+	// 4 digit $hhhh literal asks for it, as GetAsmStr prints it.
+	zeroPage := func(zp InstMode, ab InstMode) (InstMode, error) {
+		v, known, err := as.eval(expr)
+		if err != nil {
+			return 0, err
+		}
+		if known && v >= 0 && v < 0x100 && !isAsmWordLiteral(expr) {
+			return pick(zp, ab)
+		}
+		return pick(ab, zp)
+	}
+
+	switch kind {
+	case "imp":
+		return pick(imp, acc)
+	case "acc":
+		return pick(acc)
+	case "imm":
+		return pick(imm)
+	case "inx":
+		return pick(inx)
+	case "iny":
+		return pick(iny)
+	case "ind":
+		return pick(ind)
+	case "x":
+		return zeroPage(zpx, abx)
+	case "y":
+		return zeroPage(zpy, aby)
+	}
+	if asmHasMode(m, rel) {
+		return rel, nil
+	}
+	return zeroPage(zrp, abs)
+}
+
+func (as *assembler) emit(st *asmStmt) ([]uint8, error) {
+	switch {
+	case st.directive == ".byte":
+		var code []uint8
+		for _, a := range st.args {
+			if s, ok := asmString(a); ok {
+				code = append(code, []uint8(s)...)
+				continue
+			}
+			v, err := as.evalFinal(a)
+			if err != nil {
+				return nil, err
+			}
+			if v < -128 || v > 0xff {
+				return nil, fmt.Errorf("byte out of range: %s", a)
+			}
+			code = append(code, uint8(v))
+		}
+		return code, nil
+	case st.directive == ".word":
+		var code []uint8
+		for _, a := range st.args {
+			v, err := as.evalFinal(a)
+			if err != nil {
+				return nil, err
+			}
+			code = append(code, uint8(v), uint8(v>>8))
+		}
+		return code, nil
+	case st.mnemonic == "":
+		return nil, nil
+	}
+
+	opc, _ := asmLookup(st.mnemonic, st.mode, st.unofficial)
+	code := []uint8{opc}
+	_, expr := splitOperand(st.operand)
+	switch st.size {
+	case 1:
+		return code, nil
+	case 2:
+		v, err := as.evalFinal(expr)
+		if err != nil {
+			return nil, err
+		}
+		if st.mode == rel {
+			d := v - int(st.addr+2)
+			if d < -128 || d > 127 {
+				return nil, fmt.Errorf("branch out of range: %s", st.operand)
+			}
+			v = d
+		} else if v < -128 || v > 0xff {
+			return nil, fmt.Errorf("operand out of range: %s", st.operand)
+		}
+		return append(code, uint8(v)), nil
+	}
+	v, err := as.evalFinal(expr)
+	if err != nil {
+		return nil, err
+	}
+	return append(code, uint8(v), uint8(v>>8)), nil
+}
+
+func (as *assembler) evalFinal(expr string) (int, error) {
+	v, known, err := as.eval(expr)
+	if err == nil && !known {
+		err = fmt.Errorf("undefined label in: %s", expr)
+	}
+	return v, err
+}
+
+//
+// Expression evaluation
+//
+
+type asmExpr struct {
+	as    *assembler
+	s     string
+	pos   int
+	known bool
+}
+
+func (as *assembler) eval(s string) (int, bool, error) {
+	e := &asmExpr{as: as, s: s, known: true}
+	v, err := e.parseBinary(0)
+	if err != nil {
+		return 0, false, err
+	}
+	e.skipSpace()
+	if e.pos != len(e.s) {
+		return 0, false, fmt.Errorf("syntax error in expression: %s", s)
+	}
+	return v, e.known, nil
+}
+
+var asmBinaryOps = [][]string{
+	{"|"},
+	{"^"},
+	{"&"},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (e *asmExpr) skipSpace() {
+	for e.pos < len(e.s) && (e.s[e.pos] == ' ' || e.s[e.pos] == '\t') {
+		e.pos++
+	}
+}
+
+func (e *asmExpr) parseBinary(level int) (int, error) {
+	if level == len(asmBinaryOps) {
+		return e.parseUnary()
+	}
+	v, err := e.parseBinary(level + 1)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		e.skipSpace()
+		op := ""
+		for _, o := range asmBinaryOps[level] {
+			if strings.HasPrefix(e.s[e.pos:], o) {
+				op = o
+				break
+			}
+		}
+		if op == "" {
+			return v, nil
+		}
+		e.pos += len(op)
+		w, err := e.parseBinary(level + 1)
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case "|":
+			v |= w
+		case "^":
+			v ^= w
+		case "&":
+			v &= w
+		case "<<":
+			v <<= uint(w)
+		case ">>":
+			v >>= uint(w)
+		case "+":
+			v += w
+		case "-":
+			v -= w
+		case "*":
+			v *= w
+		case "/", "%":
+			if w == 0 {
+				if !e.known {
+					v = 0
+					continue
+				}
+				return 0, fmt.Errorf("division by zero")
+			}
+			if op == "/" {
+				v /= w
+			} else {
+				v %= w
+			}
+		}
+	}
+}
+
+func (e *asmExpr) parseUnary() (int, error) {
+	e.skipSpace()
+	if e.pos >= len(e.s) {
+		return 0, fmt.Errorf("expression expected")
+	}
+	switch e.s[e.pos] {
+	case '-', '~', '<', '>':
+		op := e.s[e.pos]
+		e.pos++
+		v, err := e.parseUnary()
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case '-':
+			return -v, nil
+		case '~':
+			return ^v & 0xffff, nil
+		case '<':
+			return v & 0xff, nil
+		}
+		return (v >> 8) & 0xff, nil
+	case '(':
+		e.pos++
+		v, err := e.parseBinary(0)
+		if err != nil {
+			return 0, err
+		}
+		e.skipSpace()
+		if e.pos >= len(e.s) || e.s[e.pos] != ')' {
+			return 0, fmt.Errorf("missing ')'")
+		}
+		e.pos++
+		return v, nil
+	case '*':
+		e.pos++
+		return int(e.as.pc), nil
+	}
+	return e.parseAtom()
+}
+
+func (e *asmExpr) parseAtom() (int, error) {
+	start := e.pos
+	c := e.s[e.pos]
+	switch {
+	case c == '$' || c == '%':
+		e.pos++
+		for e.pos < len(e.s) && isAlnum(e.s[e.pos]) {
+			e.pos++
+		}
+		base := 16
+		if c == '%' {
+			base = 2
+		}
+		v, err := strconv.ParseInt(e.s[start+1:e.pos], base, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number: %s", e.s[start:e.pos])
+		}
+		return int(v), nil
+	case c >= '0' && c <= '9':
+		for e.pos < len(e.s) && isAlnum(e.s[e.pos]) {
+			e.pos++
+		}
+		v, err := strconv.ParseInt(e.s[start:e.pos], 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number: %s", e.s[start:e.pos])
+		}
+		return int(v), nil
+	case c == '\'':
+		if e.pos+2 >= len(e.s) || e.s[e.pos+2] != '\'' {
+			return 0, fmt.Errorf("invalid character constant")
+		}
+		e.pos += 3
+		return int(e.s[start+1]), nil
+	case isAlnum(c):
+		for e.pos < len(e.s) && isAlnum(e.s[e.pos]) {
+			e.pos++
+		}
+		name := e.s[start:e.pos]
+		if !isIdentifier(name) {
+			return 0, fmt.Errorf("invalid label: %s", name)
+		}
+		v, ok := e.as.labels[name]
+		if !ok {
+			e.known = false
+			return 0, nil
+		}
+		return int(v), nil
+	}
+	return 0, fmt.Errorf("syntax error in expression: %s", e.s)
+}
+
+func isAlnum(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
@@ -0,0 +1,44 @@
+package nespkg
+
+import (
+	"bytes"
+	"testing"
+)
+
+type flatMemory [0x10000]uint8
+
+func (m *flatMemory) Read8(a uint16) uint8              { return m[a] }
+func (m *flatMemory) Read8NoTrace(a uint16) uint8       { return m[a] }
+func (m *flatMemory) Read16(a uint16) uint16            { return uint16(m[a]) | uint16(m[a+1])<<8 }
+func (m *flatMemory) Read16NoTrace(a uint16) uint16     { return m.Read16(a) }
+func (m *flatMemory) Write8(a uint16, v uint8)          { m[a] = v }
+func (m *flatMemory) Write8NoTrace(a uint16, v uint8)   { m[a] = v }
+func (m *flatMemory) Write16(a uint16, v uint16)        { m[a] = uint8(v); m[a+1] = uint8(v >> 8) }
+func (m *flatMemory) Write16NoTrace(a uint16, v uint16) { m.Write16(a, v) }
+
+// TestAsmRoundTrip disassembles every opcode and assembles the text again.
+// Opcodes that are aliases of each other, like the unofficial NOPs, print
+// the same, so the opcode only has to decode to the same instruction.
+func TestAsmRoundTrip(t *testing.T) {
+	operands := [][2]uint8{{0x44, 0x00}, {0xff, 0x00}, {0x34, 0x12}, {0x80, 0xff}}
+	mem := new(flatMemory)
+	const pc = 0x8000
+	for opc := 0; opc < 256; opc++ {
+		for _, opd := range operands {
+			mem[pc] = uint8(opc)
+			mem[pc+1] = opd[0]
+			mem[pc+2] = opd[1]
+			_, n, s := GetAsmStr(mem, pc)
+			prog, err := Assemble(s, pc)
+			if err != nil {
+				t.Errorf("%02X %q: %v", opc, s, err)
+				continue
+			}
+			code := prog.Segments[0].Code
+			want := mem[pc : pc+n]
+			if len(code) != n || instTable[code[0]] != instTable[opc] || !bytes.Equal(code[1:], want[1:]) {
+				t.Errorf("%02X %q: got % X, want % X", opc, s, code, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package nespkg
+
+import (
+	"os"
+	"testing"
+)
+
+// The benchmarks run sample1.nes from the top of the repository and are
+// skipped without it.
+const benchRom = "../sample1.nes"
+
+func newBenchNes(b *testing.B) *Nes {
+	if _, err := os.Stat(benchRom); err != nil {
+		b.Skipf("%s not found", benchRom)
+	}
+	nes := NewNes(&Conf{}, &nullDisplay{})
+	if err := nes.LoadRom(benchRom); err != nil {
+		b.Fatal(err)
+	}
+	nes.Reset()
+	return nes
+}
+
+func BenchmarkExecuteInst(b *testing.B) {
+	nes := newBenchNes(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		nes.cpu.executeInst()
+	}
+}
+
+func BenchmarkRunFrames(b *testing.B) {
+	nes := newBenchNes(b)
+	b.ResetTimer()
+	nes.RunFrames(b.N)
+}
@@ -0,0 +1,222 @@
+package nespkg
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+//
+// Code/Data Logger
+//
+// The .cdl file is the FCEUX/Mesen layout: one flag byte per PRG ROM byte
+// followed by one flag byte per CHR ROM byte.
+//
+
+const (
+	CDL_PRG_CODE          = 0x01
+	CDL_PRG_DATA          = 0x02
+	CDL_PRG_BANK_MASK     = 0x0c // CPU address bits 13-14 the byte was accessed at
+	CDL_PRG_INDIRECT_CODE = 0x10
+	CDL_PRG_INDIRECT_DATA = 0x20
+	CDL_PRG_PCM           = 0x40 // DMC sample bytes, not logged until there is a DMC
+)
+
+// Bits 0-1 are the standard ones. Bits 2-3 tell background and sprite
+// tiles apart for the statistics and are not saved.
+const (
+	CDL_CHR_DRAWN  = 0x01
+	CDL_CHR_READ   = 0x02
+	CDL_CHR_BG     = 0x04
+	CDL_CHR_SPRITE = 0x08
+	cdlChrSaveMask = CDL_CHR_DRAWN | CDL_CHR_READ
+)
+
+type CodeDataLogger struct {
+	nes          *Nes
+	prg          []uint8
+	chr          []uint8
+	indirect     bool
+	indirectJump bool
+}
+
+func NewCodeDataLogger(nes *Nes) *CodeDataLogger {
+	cdl := new(CodeDataLogger)
+	cdl.nes = nes
+	cdl.prg = make([]uint8, len(nes.rom.prgRom))
+	cdl.chr = make([]uint8, len(nes.rom.chrRom))
+	return cdl
+}
+
+func cdlBank(address uint16) uint8 {
+	return uint8(bits(uint(address), 13, 2) << 2)
+}
+
+func (cdl *CodeDataLogger) logPrg(address uint16, flag uint8) {
+	if i := cdl.nes.mapper.prgRomOffset(address); i >= 0 {
+		cdl.prg[i] |= flag | cdlBank(address)
+	}
+}
+
+// logInst is called before the instruction at the PC is executed.
+func (cdl *CodeDataLogger) logInst(cpu *Cpu) {
+	inst := &decodeTable[cpu.peek8(cpu.pc)]
+	if cdl.indirectJump {
+		cdl.logPrg(cpu.pc, CDL_PRG_INDIRECT_CODE)
+	}
+	for i := uint16(0); i < uint16(inst.bytes); i++ {
+		cdl.logPrg(cpu.pc+i, CDL_PRG_CODE)
+	}
+	cdl.indirect = inst.mode == inx || inst.mode == iny
+	cdl.indirectJump = inst.mode == ind
+}
+
+// logInterrupt is called when the CPU enters an interrupt handler, which
+// does not go through logInst. The vector and the handler are not reached
+// through the operand of the last instruction.
+func (cdl *CodeDataLogger) logInterrupt() {
+	cdl.indirect = false
+	cdl.indirectJump = false
+}
+
+func (cdl *CodeDataLogger) logData(address uint16) {
+	if cdl.indirect {
+		cdl.logPrg(address, CDL_PRG_DATA|CDL_PRG_INDIRECT_DATA)
+	} else {
+		cdl.logPrg(address, CDL_PRG_DATA)
+	}
+}
+
+func (cdl *CodeDataLogger) logChr(address uint16, flag uint8) {
+	if i := cdl.nes.mapper.chrRomOffset(address); i >= 0 {
+		cdl.chr[i] |= flag
+	}
+}
+
+func (cdl *CodeDataLogger) Save(filename string) error {
+	data := make([]uint8, 0, len(cdl.prg)+len(cdl.chr))
+	data = append(data, cdl.prg...)
+	for _, f := range cdl.chr {
+		data = append(data, f&cdlChrSaveMask)
+	}
+	return os.WriteFile(filename, data, 0644)
+}
+
+// Load merges a previously saved log, so that logging can go on across
+// sessions.
+func (cdl *CodeDataLogger) Load(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if len(data) != len(cdl.prg)+len(cdl.chr) {
+		return fmt.Errorf("%s: CDL size %d does not match the ROM", filename, len(data))
+	}
+	for i := range cdl.prg {
+		cdl.prg[i] |= data[i]
+	}
+	for i := range cdl.chr {
+		cdl.chr[i] |= data[len(cdl.prg)+i]
+	}
+	return nil
+}
+
+func (cdl *CodeDataLogger) Reset() {
+	for i := range cdl.prg {
+		cdl.prg[i] = 0
+	}
+	for i := range cdl.chr {
+		cdl.chr[i] = 0
+	}
+}
+
+func cdlCount(log []uint8, mask uint8) int {
+	n := 0
+	for _, f := range log {
+		if f&mask != 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func (cdl *CodeDataLogger) PrintStats() {
+	pct := func(n int, total int) float64 {
+		if total == 0 {
+			return 0
+		}
+		return float64(n) * 100 / float64(total)
+	}
+	prg := len(cdl.prg)
+	chr := len(cdl.chr)
+	code := cdlCount(cdl.prg, CDL_PRG_CODE)
+	data := cdlCount(cdl.prg, CDL_PRG_DATA)
+	logged := cdlCount(cdl.prg, CDL_PRG_CODE|CDL_PRG_DATA)
+	drawn := cdlCount(cdl.chr, CDL_CHR_DRAWN)
+	read := cdlCount(cdl.chr, CDL_CHR_READ)
+	bg := cdlCount(cdl.chr, CDL_CHR_BG)
+	sprite := cdlCount(cdl.chr, CDL_CHR_SPRITE)
+	fmt.Printf("PRG: code %d, data %d, logged %d/%d (%.1f%%)\n", code, data, logged, prg, pct(logged, prg))
+	fmt.Printf("CHR: drawn %d (bg %d, sprites %d), read %d, logged %d/%d (%.1f%%)\n",
+		drawn, bg, sprite, read, cdlCount(cdl.chr, CDL_CHR_DRAWN|CDL_CHR_READ), chr, pct(drawn, chr))
+}
+
+// EnableCdl starts code/data logging. It has to be called after LoadRom.
+func (nes *Nes) EnableCdl() error {
+	if nes.rom == nil {
+		return errors.New("cdl: no ROM loaded")
+	}
+	if nes.cdl == nil {
+		nes.cdl = NewCodeDataLogger(nes)
+	}
+	return nil
+}
+
+func (nes *Nes) SaveCdl(filename string) error {
+	if nes.cdl == nil {
+		return errors.New("cdl: logging is not enabled")
+	}
+	return nes.cdl.Save(filename)
+}
+
+type DbgCmdCdl struct {
+	DbgCmdBase
+}
+
+func NewDbgCmdCdl(args []string) (DbgCmd, error) {
+	if len(args) > 2 {
+		return nil, errors.New("cdl: invalid arguments")
+	}
+	c := new(DbgCmdCdl)
+	c.args = args
+	return c, nil
+}
+
+// cdl                 show statistics, enabling the logger if needed
+// cdl save <file>     write the .cdl file
+// cdl load <file>     merge a .cdl file
+// cdl reset           clear the log
+func (cmd *DbgCmdCdl) execCmd(dbg *Debugger) bool {
+	nes := dbg.nes
+	if err := nes.EnableCdl(); err != nil {
+		fmt.Println(err)
+		return true
+	}
+	var err error
+	switch {
+	case len(cmd.args) == 0:
+		nes.cdl.PrintStats()
+	case len(cmd.args) == 2 && cmd.args[0] == "save":
+		err = nes.cdl.Save(cmd.args[1])
+	case len(cmd.args) == 2 && cmd.args[0] == "load":
+		err = nes.cdl.Load(cmd.args[1])
+	case len(cmd.args) == 1 && cmd.args[0] == "reset":
+		nes.cdl.Reset()
+	default:
+		err = errors.New("cdl: invalid arguments")
+	}
+	if err != nil {
+		fmt.Println(err)
+	}
+	return true
+}
@@ -1,7 +1,6 @@
 package nespkg
 
 import (
-	"errors"
 	"fmt"
 )
 
@@ -31,10 +30,20 @@ const NES_SIZE_H = 256
 const NES_SIZE_V = 240
 
 type InstParams struct {
-	mnemonic string
-	mode     InstMode
-	bytes    uint
-	cycle    uint
+	mnemonic   string
+	mode       InstMode
+	bytes      uint
+	cycle      uint
+	unofficial bool
+}
+
+// marker returns the character printed in front of the mnemonic in
+// disassembly; unofficial opcodes are flagged with '*'.
+func (p InstParams) marker() byte {
+	if p.unofficial {
+		return '*'
+	}
+	return ' '
 }
 
 type InstMode int
@@ -62,7 +71,7 @@ type ModeOps struct {
 	getOpdString func(mem Memory, pc uint16) string
 }
 
-var modeOpsTable = map[InstMode]ModeOps{
+var modeOpsTable = [...]ModeOps{
 	abs: {getAddrAbs, getValueAbs, setValueAbs, getOpdstrAbs},
 	abx: {getAddrAbx, getValueAbx, setValueAbx, getOpdstrAbx},
 	aby: {getAddrAby, getValueAby, setValueAby, getOpdstrAby},
@@ -78,314 +87,544 @@ var modeOpsTable = map[InstMode]ModeOps{
 	zpy: {getAddrZpy, getValueZpy, setValueZpy, getOpdstrZpy},
 }
 
-var instTable = map[uint8]InstParams{
-	0x00: {"brk", imp, 1, 7},
-	0x01: {"ora", inx, 2, 6},
-	0x05: {"ora", zrp, 2, 3},
-	0x06: {"asl", zrp, 2, 5},
-	0x08: {"php", imp, 1, 3},
-	0x09: {"ora", imm, 2, 2},
-	0x0A: {"asl", acc, 1, 2},
-	0x0D: {"ora", abs, 3, 4},
-	0x0E: {"asl", abs, 3, 6},
-	0x10: {"bpl", rel, 2, 2},
-	0x11: {"ora", iny, 2, 5},
-	0x15: {"ora", zpx, 2, 4},
-	0x16: {"asl", zpx, 2, 6},
-	0x18: {"clc", imp, 1, 2},
-	0x19: {"ora", aby, 3, 4},
-	0x1D: {"ora", abx, 3, 4},
-	0x1E: {"asl", abx, 3, 7},
-	0x20: {"jsr", abs, 3, 6},
-	0x21: {"and", inx, 2, 6},
-	0x24: {"bit", zrp, 2, 3},
-	0x25: {"and", zrp, 2, 3},
-	0x26: {"rol", zrp, 2, 5},
-	0x28: {"plp", imp, 1, 4},
-	0x29: {"and", imm, 2, 2},
-	0x2A: {"rol", acc, 1, 2},
-	0x2C: {"bit", abs, 3, 4},
-	0x2D: {"and", abs, 3, 4},
-	0x2E: {"rol", abs, 3, 6},
-	0x30: {"bmi", rel, 2, 2},
-	0x31: {"and", iny, 2, 5},
-	0x35: {"and", zpx, 2, 4},
-	0x36: {"rol", zpx, 2, 6},
-	0x38: {"sec", imp, 1, 2},
-	0x39: {"and", aby, 3, 4},
-	0x3D: {"and", abx, 3, 4},
-	0x3E: {"rol", abx, 3, 7},
-	0x40: {"rti", imp, 1, 6},
-	0x41: {"eor", inx, 2, 6},
-	0x45: {"eor", zrp, 2, 3},
-	0x46: {"lsr", zrp, 2, 5},
-	0x48: {"pha", imp, 1, 3},
-	0x49: {"eor", imm, 2, 2},
-	0x4A: {"lsr", acc, 1, 2},
-	0x4C: {"jmp", abs, 3, 3},
-	0x4D: {"eor", abs, 3, 4},
-	0x4E: {"lsr", abs, 3, 6},
-	0x50: {"bvc", rel, 2, 2},
-	0x51: {"eor", iny, 2, 5},
-	0x55: {"eor", zpx, 2, 4},
-	0x56: {"lsr", zpx, 2, 6},
-	0x58: {"cli", imp, 1, 2},
-	0x59: {"eor", aby, 3, 4},
-	0x5D: {"eor", abx, 3, 4},
-	0x5E: {"lsr", abx, 3, 7},
-	0x60: {"rts", imp, 1, 6},
-	0x61: {"adc", inx, 2, 6},
-	0x65: {"adc", zrp, 2, 3},
-	0x66: {"ror", zrp, 2, 5},
-	0x68: {"pla", imp, 1, 4},
-	0x69: {"adc", imm, 2, 2},
-	0x6A: {"ror", acc, 1, 2},
-	0x6C: {"jmp", ind, 3, 5},
-	0x6D: {"adc", abs, 3, 4},
-	0x6E: {"ror", abs, 3, 6},
-	0x70: {"bvs", rel, 2, 2},
-	0x71: {"adc", iny, 2, 5},
-	0x75: {"adc", zpx, 2, 4},
-	0x76: {"ror", zpx, 2, 6},
-	0x78: {"sei", imp, 1, 2},
-	0x79: {"adc", aby, 3, 4},
-	0x7D: {"adc", abx, 3, 4},
-	0x7E: {"ror", abx, 3, 7},
-	0x81: {"sta", inx, 2, 6},
-	0x84: {"sty", zrp, 2, 3},
-	0x85: {"sta", zrp, 2, 3},
-	0x86: {"stx", zrp, 2, 3},
-	0x88: {"dey", imp, 1, 2},
-	0x8A: {"txa", imp, 1, 2},
-	0x8C: {"sty", abs, 3, 4},
-	0x8D: {"sta", abs, 3, 4},
-	0x8E: {"stx", abs, 3, 4},
-	0x90: {"bcc", rel, 2, 2},
-	0x91: {"sta", iny, 2, 6},
-	0x94: {"sty", zpx, 2, 4},
-	0x95: {"sta", zpx, 2, 4},
-	0x96: {"stx", zpy, 2, 4},
-	0x98: {"tya", imp, 1, 2},
-	0x99: {"sta", aby, 3, 5},
-	0x9A: {"txs", imp, 1, 2},
-	0x9D: {"sta", abx, 3, 5},
-	0xA0: {"ldy", imm, 2, 2},
-	0xA1: {"lda", inx, 2, 6},
-	0xA2: {"ldx", imm, 2, 2},
-	0xA4: {"ldy", zrp, 2, 3},
-	0xA5: {"lda", zrp, 2, 3},
-	0xA6: {"ldx", zrp, 2, 3},
-	0xA8: {"tay", imp, 1, 2},
-	0xA9: {"lda", imm, 2, 2},
-	0xAA: {"tax", imp, 1, 2},
-	0xAC: {"ldy", abs, 3, 4},
-	0xAD: {"lda", abs, 3, 4},
-	0xAE: {"ldx", abs, 3, 4},
-	0xB0: {"bcs", rel, 2, 2},
-	0xB1: {"lda", iny, 2, 5},
-	0xB4: {"ldy", zpx, 2, 4},
-	0xB5: {"lda", zpx, 2, 4},
-	0xB6: {"ldx", zpy, 2, 4},
-	0xB8: {"clv", imp, 1, 2},
-	0xB9: {"lda", aby, 3, 4},
-	0xBA: {"tsx", imp, 1, 2},
-	0xBC: {"ldy", abx, 3, 4},
-	0xBD: {"lda", abx, 3, 4},
-	0xBE: {"ldx", aby, 3, 4},
-	0xC0: {"cpy", imm, 2, 2},
-	0xC1: {"cmp", inx, 2, 6},
-	0xC4: {"cpy", zrp, 2, 3},
-	0xC5: {"cmp", zrp, 2, 3},
-	0xC6: {"dec", zrp, 2, 5},
-	0xC8: {"iny", imp, 1, 2},
-	0xC9: {"cmp", imm, 2, 2},
-	0xCA: {"dex", imp, 1, 2},
-	0xCC: {"cpy", abs, 3, 4},
-	0xCD: {"cmp", abs, 3, 4},
-	0xCE: {"dec", abs, 3, 6},
-	0xD0: {"bne", rel, 2, 2},
-	0xD1: {"cmp", iny, 2, 5},
-	0xD5: {"cmp", zpx, 2, 4},
-	0xD6: {"dec", zpx, 2, 6},
-	0xD8: {"cld", imp, 1, 2},
-	0xD9: {"cmp", aby, 3, 4},
-	0xDD: {"cmp", abx, 3, 4},
-	0xDE: {"dec", abx, 3, 7},
-	0xE0: {"cpx", imm, 2, 2},
-	0xE1: {"sbc", inx, 2, 6},
-	0xE4: {"cpx", zrp, 2, 3},
-	0xE5: {"sbc", zrp, 2, 3},
-	0xE6: {"inc", zrp, 2, 5},
-	0xE8: {"inx", imp, 1, 2},
-	0xE9: {"sbc", imm, 2, 2},
-	0xEA: {"nop", imp, 1, 2},
-	0xEC: {"cpx", abs, 3, 4},
-	0xED: {"sbc", abs, 3, 4},
-	0xEE: {"inc", abs, 3, 6},
-	0xF0: {"beq", rel, 2, 2},
-	0xF1: {"sbc", iny, 2, 5},
-	0xF5: {"sbc", zpx, 2, 4},
-	0xF6: {"inc", zpx, 2, 6},
-	0xF8: {"sed", imp, 1, 2},
-	0xF9: {"sbc", aby, 3, 4},
-	0xFD: {"sbc", abx, 3, 4},
-	0xFE: {"inc", abx, 3, 7},
-}
-
-type InstHandler func(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint
-
-var instHandlerTable = map[uint8]InstHandler{
+var instTable = [256]InstParams{
+	0x00: {"brk", imp, 1, 7, false},
+	0x01: {"ora", inx, 2, 6, false},
+	0x02: {"kil", imp, 1, 2, true},
+	0x03: {"slo", inx, 2, 8, true},
+	0x04: {"nop", zrp, 2, 3, true},
+	0x05: {"ora", zrp, 2, 3, false},
+	0x06: {"asl", zrp, 2, 5, false},
+	0x07: {"slo", zrp, 2, 5, true},
+	0x08: {"php", imp, 1, 3, false},
+	0x09: {"ora", imm, 2, 2, false},
+	0x0A: {"asl", acc, 1, 2, false},
+	0x0B: {"anc", imm, 2, 2, true},
+	0x0C: {"nop", abs, 3, 4, true},
+	0x0D: {"ora", abs, 3, 4, false},
+	0x0E: {"asl", abs, 3, 6, false},
+	0x0F: {"slo", abs, 3, 6, true},
+	0x10: {"bpl", rel, 2, 2, false},
+	0x11: {"ora", iny, 2, 5, false},
+	0x12: {"kil", imp, 1, 2, true},
+	0x13: {"slo", iny, 2, 8, true},
+	0x14: {"nop", zpx, 2, 4, true},
+	0x15: {"ora", zpx, 2, 4, false},
+	0x16: {"asl", zpx, 2, 6, false},
+	0x17: {"slo", zpx, 2, 6, true},
+	0x18: {"clc", imp, 1, 2, false},
+	0x19: {"ora", aby, 3, 4, false},
+	0x1A: {"nop", imp, 1, 2, true},
+	0x1B: {"slo", aby, 3, 7, true},
+	0x1C: {"nop", abx, 3, 4, true},
+	0x1D: {"ora", abx, 3, 4, false},
+	0x1E: {"asl", abx, 3, 7, false},
+	0x1F: {"slo", abx, 3, 7, true},
+	0x20: {"jsr", abs, 3, 6, false},
+	0x21: {"and", inx, 2, 6, false},
+	0x22: {"kil", imp, 1, 2, true},
+	0x23: {"rla", inx, 2, 8, true},
+	0x24: {"bit", zrp, 2, 3, false},
+	0x25: {"and", zrp, 2, 3, false},
+	0x26: {"rol", zrp, 2, 5, false},
+	0x27: {"rla", zrp, 2, 5, true},
+	0x28: {"plp", imp, 1, 4, false},
+	0x29: {"and", imm, 2, 2, false},
+	0x2A: {"rol", acc, 1, 2, false},
+	0x2B: {"anc", imm, 2, 2, true},
+	0x2C: {"bit", abs, 3, 4, false},
+	0x2D: {"and", abs, 3, 4, false},
+	0x2E: {"rol", abs, 3, 6, false},
+	0x2F: {"rla", abs, 3, 6, true},
+	0x30: {"bmi", rel, 2, 2, false},
+	0x31: {"and", iny, 2, 5, false},
+	0x32: {"kil", imp, 1, 2, true},
+	0x33: {"rla", iny, 2, 8, true},
+	0x34: {"nop", zpx, 2, 4, true},
+	0x35: {"and", zpx, 2, 4, false},
+	0x36: {"rol", zpx, 2, 6, false},
+	0x37: {"rla", zpx, 2, 6, true},
+	0x38: {"sec", imp, 1, 2, false},
+	0x39: {"and", aby, 3, 4, false},
+	0x3A: {"nop", imp, 1, 2, true},
+	0x3B: {"rla", aby, 3, 7, true},
+	0x3C: {"nop", abx, 3, 4, true},
+	0x3D: {"and", abx, 3, 4, false},
+	0x3E: {"rol", abx, 3, 7, false},
+	0x3F: {"rla", abx, 3, 7, true},
+	0x40: {"rti", imp, 1, 6, false},
+	0x41: {"eor", inx, 2, 6, false},
+	0x42: {"kil", imp, 1, 2, true},
+	0x43: {"sre", inx, 2, 8, true},
+	0x44: {"nop", zrp, 2, 3, true},
+	0x45: {"eor", zrp, 2, 3, false},
+	0x46: {"lsr", zrp, 2, 5, false},
+	0x47: {"sre", zrp, 2, 5, true},
+	0x48: {"pha", imp, 1, 3, false},
+	0x49: {"eor", imm, 2, 2, false},
+	0x4A: {"lsr", acc, 1, 2, false},
+	0x4B: {"alr", imm, 2, 2, true},
+	0x4C: {"jmp", abs, 3, 3, false},
+	0x4D: {"eor", abs, 3, 4, false},
+	0x4E: {"lsr", abs, 3, 6, false},
+	0x4F: {"sre", abs, 3, 6, true},
+	0x50: {"bvc", rel, 2, 2, false},
+	0x51: {"eor", iny, 2, 5, false},
+	0x52: {"kil", imp, 1, 2, true},
+	0x53: {"sre", iny, 2, 8, true},
+	0x54: {"nop", zpx, 2, 4, true},
+	0x55: {"eor", zpx, 2, 4, false},
+	0x56: {"lsr", zpx, 2, 6, false},
+	0x57: {"sre", zpx, 2, 6, true},
+	0x58: {"cli", imp, 1, 2, false},
+	0x59: {"eor", aby, 3, 4, false},
+	0x5A: {"nop", imp, 1, 2, true},
+	0x5B: {"sre", aby, 3, 7, true},
+	0x5C: {"nop", abx, 3, 4, true},
+	0x5D: {"eor", abx, 3, 4, false},
+	0x5E: {"lsr", abx, 3, 7, false},
+	0x5F: {"sre", abx, 3, 7, true},
+	0x60: {"rts", imp, 1, 6, false},
+	0x61: {"adc", inx, 2, 6, false},
+	0x62: {"kil", imp, 1, 2, true},
+	0x63: {"rra", inx, 2, 8, true},
+	0x64: {"nop", zrp, 2, 3, true},
+	0x65: {"adc", zrp, 2, 3, false},
+	0x66: {"ror", zrp, 2, 5, false},
+	0x67: {"rra", zrp, 2, 5, true},
+	0x68: {"pla", imp, 1, 4, false},
+	0x69: {"adc", imm, 2, 2, false},
+	0x6A: {"ror", acc, 1, 2, false},
+	0x6B: {"arr", imm, 2, 2, true},
+	0x6C: {"jmp", ind, 3, 5, false},
+	0x6D: {"adc", abs, 3, 4, false},
+	0x6E: {"ror", abs, 3, 6, false},
+	0x6F: {"rra", abs, 3, 6, true},
+	0x70: {"bvs", rel, 2, 2, false},
+	0x71: {"adc", iny, 2, 5, false},
+	0x72: {"kil", imp, 1, 2, true},
+	0x73: {"rra", iny, 2, 8, true},
+	0x74: {"nop", zpx, 2, 4, true},
+	0x75: {"adc", zpx, 2, 4, false},
+	0x76: {"ror", zpx, 2, 6, false},
+	0x77: {"rra", zpx, 2, 6, true},
+	0x78: {"sei", imp, 1, 2, false},
+	0x79: {"adc", aby, 3, 4, false},
+	0x7A: {"nop", imp, 1, 2, true},
+	0x7B: {"rra", aby, 3, 7, true},
+	0x7C: {"nop", abx, 3, 4, true},
+	0x7D: {"adc", abx, 3, 4, false},
+	0x7E: {"ror", abx, 3, 7, false},
+	0x7F: {"rra", abx, 3, 7, true},
+	0x80: {"nop", imm, 2, 2, true},
+	0x81: {"sta", inx, 2, 6, false},
+	0x82: {"nop", imm, 2, 2, true},
+	0x83: {"sax", inx, 2, 6, true},
+	0x84: {"sty", zrp, 2, 3, false},
+	0x85: {"sta", zrp, 2, 3, false},
+	0x86: {"stx", zrp, 2, 3, false},
+	0x87: {"sax", zrp, 2, 3, true},
+	0x88: {"dey", imp, 1, 2, false},
+	0x89: {"nop", imm, 2, 2, true},
+	0x8A: {"txa", imp, 1, 2, false},
+	0x8B: {"xaa", imm, 2, 2, true},
+	0x8C: {"sty", abs, 3, 4, false},
+	0x8D: {"sta", abs, 3, 4, false},
+	0x8E: {"stx", abs, 3, 4, false},
+	0x8F: {"sax", abs, 3, 4, true},
+	0x90: {"bcc", rel, 2, 2, false},
+	0x91: {"sta", iny, 2, 6, false},
+	0x92: {"kil", imp, 1, 2, true},
+	0x93: {"ahx", iny, 2, 6, true},
+	0x94: {"sty", zpx, 2, 4, false},
+	0x95: {"sta", zpx, 2, 4, false},
+	0x96: {"stx", zpy, 2, 4, false},
+	0x97: {"sax", zpy, 2, 4, true},
+	0x98: {"tya", imp, 1, 2, false},
+	0x99: {"sta", aby, 3, 5, false},
+	0x9A: {"txs", imp, 1, 2, false},
+	0x9B: {"tas", aby, 3, 5, true},
+	0x9C: {"shy", abx, 3, 5, true},
+	0x9D: {"sta", abx, 3, 5, false},
+	0x9E: {"shx", aby, 3, 5, true},
+	0x9F: {"ahx", aby, 3, 5, true},
+	0xA0: {"ldy", imm, 2, 2, false},
+	0xA1: {"lda", inx, 2, 6, false},
+	0xA2: {"ldx", imm, 2, 2, false},
+	0xA3: {"lax", inx, 2, 6, true},
+	0xA4: {"ldy", zrp, 2, 3, false},
+	0xA5: {"lda", zrp, 2, 3, false},
+	0xA6: {"ldx", zrp, 2, 3, false},
+	0xA7: {"lax", zrp, 2, 3, true},
+	0xA8: {"tay", imp, 1, 2, false},
+	0xA9: {"lda", imm, 2, 2, false},
+	0xAA: {"tax", imp, 1, 2, false},
+	0xAB: {"lxa", imm, 2, 2, true},
+	0xAC: {"ldy", abs, 3, 4, false},
+	0xAD: {"lda", abs, 3, 4, false},
+	0xAE: {"ldx", abs, 3, 4, false},
+	0xAF: {"lax", abs, 3, 4, true},
+	0xB0: {"bcs", rel, 2, 2, false},
+	0xB1: {"lda", iny, 2, 5, false},
+	0xB2: {"kil", imp, 1, 2, true},
+	0xB3: {"lax", iny, 2, 5, true},
+	0xB4: {"ldy", zpx, 2, 4, false},
+	0xB5: {"lda", zpx, 2, 4, false},
+	0xB6: {"ldx", zpy, 2, 4, false},
+	0xB7: {"lax", zpy, 2, 4, true},
+	0xB8: {"clv", imp, 1, 2, false},
+	0xB9: {"lda", aby, 3, 4, false},
+	0xBA: {"tsx", imp, 1, 2, false},
+	0xBB: {"las", aby, 3, 4, true},
+	0xBC: {"ldy", abx, 3, 4, false},
+	0xBD: {"lda", abx, 3, 4, false},
+	0xBE: {"ldx", aby, 3, 4, false},
+	0xBF: {"lax", aby, 3, 4, true},
+	0xC0: {"cpy", imm, 2, 2, false},
+	0xC1: {"cmp", inx, 2, 6, false},
+	0xC2: {"nop", imm, 2, 2, true},
+	0xC3: {"dcp", inx, 2, 8, true},
+	0xC4: {"cpy", zrp, 2, 3, false},
+	0xC5: {"cmp", zrp, 2, 3, false},
+	0xC6: {"dec", zrp, 2, 5, false},
+	0xC7: {"dcp", zrp, 2, 5, true},
+	0xC8: {"iny", imp, 1, 2, false},
+	0xC9: {"cmp", imm, 2, 2, false},
+	0xCA: {"dex", imp, 1, 2, false},
+	0xCB: {"axs", imm, 2, 2, true},
+	0xCC: {"cpy", abs, 3, 4, false},
+	0xCD: {"cmp", abs, 3, 4, false},
+	0xCE: {"dec", abs, 3, 6, false},
+	0xCF: {"dcp", abs, 3, 6, true},
+	0xD0: {"bne", rel, 2, 2, false},
+	0xD1: {"cmp", iny, 2, 5, false},
+	0xD2: {"kil", imp, 1, 2, true},
+	0xD3: {"dcp", iny, 2, 8, true},
+	0xD4: {"nop", zpx, 2, 4, true},
+	0xD5: {"cmp", zpx, 2, 4, false},
+	0xD6: {"dec", zpx, 2, 6, false},
+	0xD7: {"dcp", zpx, 2, 6, true},
+	0xD8: {"cld", imp, 1, 2, false},
+	0xD9: {"cmp", aby, 3, 4, false},
+	0xDA: {"nop", imp, 1, 2, true},
+	0xDB: {"dcp", aby, 3, 7, true},
+	0xDC: {"nop", abx, 3, 4, true},
+	0xDD: {"cmp", abx, 3, 4, false},
+	0xDE: {"dec", abx, 3, 7, false},
+	0xDF: {"dcp", abx, 3, 7, true},
+	0xE0: {"cpx", imm, 2, 2, false},
+	0xE1: {"sbc", inx, 2, 6, false},
+	0xE2: {"nop", imm, 2, 2, true},
+	0xE3: {"isc", inx, 2, 8, true},
+	0xE4: {"cpx", zrp, 2, 3, false},
+	0xE5: {"sbc", zrp, 2, 3, false},
+	0xE6: {"inc", zrp, 2, 5, false},
+	0xE7: {"isc", zrp, 2, 5, true},
+	0xE8: {"inx", imp, 1, 2, false},
+	0xE9: {"sbc", imm, 2, 2, false},
+	0xEA: {"nop", imp, 1, 2, false},
+	0xEB: {"sbc", imm, 2, 2, true},
+	0xEC: {"cpx", abs, 3, 4, false},
+	0xED: {"sbc", abs, 3, 4, false},
+	0xEE: {"inc", abs, 3, 6, false},
+	0xEF: {"isc", abs, 3, 6, true},
+	0xF0: {"beq", rel, 2, 2, false},
+	0xF1: {"sbc", iny, 2, 5, false},
+	0xF2: {"kil", imp, 1, 2, true},
+	0xF3: {"isc", iny, 2, 8, true},
+	0xF4: {"nop", zpx, 2, 4, true},
+	0xF5: {"sbc", zpx, 2, 4, false},
+	0xF6: {"inc", zpx, 2, 6, false},
+	0xF7: {"isc", zpx, 2, 6, true},
+	0xF8: {"sed", imp, 1, 2, false},
+	0xF9: {"sbc", aby, 3, 4, false},
+	0xFA: {"nop", imp, 1, 2, true},
+	0xFB: {"isc", aby, 3, 7, true},
+	0xFC: {"nop", abx, 3, 4, true},
+	0xFD: {"sbc", abx, 3, 4, false},
+	0xFE: {"inc", abx, 3, 7, false},
+	0xFF: {"isc", abx, 3, 7, true},
+}
+
+type InstHandler func(cpu *Cpu, inst *Inst) uint
+
+var instHandlerTable = [256]InstHandler{
 	0x00: execBrk,
 	0x01: execOra,
+	0x02: execKil,
+	0x03: execSlo,
+	0x04: execNop,
 	0x05: execOra,
 	0x06: execAsl,
+	0x07: execSlo,
 	0x08: execPhp,
 	0x09: execOra,
 	0x0A: execAsl,
+	0x0B: execAnc,
+	0x0C: execNop,
 	0x0D: execOra,
 	0x0E: execAsl,
+	0x0F: execSlo,
 	0x10: execBpl,
 	0x11: execOra,
+	0x12: execKil,
+	0x13: execSlo,
+	0x14: execNop,
 	0x15: execOra,
 	0x16: execAsl,
+	0x17: execSlo,
 	0x18: execClc,
 	0x19: execOra,
+	0x1A: execNop,
+	0x1B: execSlo,
+	0x1C: execNop,
 	0x1D: execOra,
 	0x1E: execAsl,
+	0x1F: execSlo,
 	0x20: execJsr,
 	0x21: execAnd,
+	0x22: execKil,
+	0x23: execRla,
 	0x24: execBit,
 	0x25: execAnd,
 	0x26: execRol,
+	0x27: execRla,
 	0x28: execPlp,
 	0x29: execAnd,
 	0x2A: execRol,
+	0x2B: execAnc,
 	0x2C: execBit,
 	0x2D: execAnd,
 	0x2E: execRol,
+	0x2F: execRla,
 	0x30: execBmi,
 	0x31: execAnd,
+	0x32: execKil,
+	0x33: execRla,
+	0x34: execNop,
 	0x35: execAnd,
 	0x36: execRol,
+	0x37: execRla,
 	0x38: execSec,
 	0x39: execAnd,
+	0x3A: execNop,
+	0x3B: execRla,
+	0x3C: execNop,
 	0x3D: execAnd,
 	0x3E: execRol,
+	0x3F: execRla,
 	0x40: execRti,
 	0x41: execEor,
+	0x42: execKil,
+	0x43: execSre,
+	0x44: execNop,
 	0x45: execEor,
 	0x46: execLsr,
+	0x47: execSre,
 	0x48: execPha,
 	0x49: execEor,
 	0x4A: execLsr,
+	0x4B: execAlr,
 	0x4C: execJmp,
 	0x4D: execEor,
 	0x4E: execLsr,
+	0x4F: execSre,
 	0x50: execBvc,
 	0x51: execEor,
+	0x52: execKil,
+	0x53: execSre,
+	0x54: execNop,
 	0x55: execEor,
 	0x56: execLsr,
+	0x57: execSre,
 	0x58: execCli,
 	0x59: execEor,
+	0x5A: execNop,
+	0x5B: execSre,
+	0x5C: execNop,
 	0x5D: execEor,
 	0x5E: execLsr,
+	0x5F: execSre,
 	0x60: execRts,
 	0x61: execAdc,
+	0x62: execKil,
+	0x63: execRra,
+	0x64: execNop,
 	0x65: execAdc,
 	0x66: execRor,
+	0x67: execRra,
 	0x68: execPla,
 	0x69: execAdc,
 	0x6A: execRor,
+	0x6B: execArr,
 	0x6C: execJmp,
 	0x6D: execAdc,
 	0x6E: execRor,
+	0x6F: execRra,
 	0x70: execBvs,
 	0x71: execAdc,
+	0x72: execKil,
+	0x73: execRra,
+	0x74: execNop,
 	0x75: execAdc,
 	0x76: execRor,
+	0x77: execRra,
 	0x78: execSei,
 	0x79: execAdc,
+	0x7A: execNop,
+	0x7B: execRra,
+	0x7C: execNop,
 	0x7D: execAdc,
 	0x7E: execRor,
+	0x7F: execRra,
+	0x80: execNop,
 	0x81: execSta,
+	0x82: execNop,
+	0x83: execSax,
 	0x84: execSty,
 	0x85: execSta,
 	0x86: execStx,
+	0x87: execSax,
 	0x88: execDey,
+	0x89: execNop,
 	0x8A: execTxa,
+	0x8B: execXaa,
 	0x8C: execSty,
 	0x8D: execSta,
 	0x8E: execStx,
+	0x8F: execSax,
 	0x90: execBcc,
 	0x91: execSta,
+	0x92: execKil,
+	0x93: execAhx,
 	0x94: execSty,
 	0x95: execSta,
 	0x96: execStx,
+	0x97: execSax,
 	0x98: execTya,
 	0x99: execSta,
 	0x9A: execTxs,
+	0x9B: execTas,
+	0x9C: execShy,
 	0x9D: execSta,
+	0x9E: execShx,
+	0x9F: execAhx,
 	0xA0: execLdy,
 	0xA1: execLda,
 	0xA2: execLdx,
+	0xA3: execLax,
 	0xA4: execLdy,
 	0xA5: execLda,
 	0xA6: execLdx,
+	0xA7: execLax,
 	0xA8: execTay,
 	0xA9: execLda,
 	0xAA: execTax,
+	0xAB: execLxa,
 	0xAC: execLdy,
 	0xAD: execLda,
 	0xAE: execLdx,
+	0xAF: execLax,
 	0xB0: execBcs,
 	0xB1: execLda,
+	0xB2: execKil,
+	0xB3: execLax,
 	0xB4: execLdy,
 	0xB5: execLda,
 	0xB6: execLdx,
+	0xB7: execLax,
 	0xB8: execClv,
 	0xB9: execLda,
 	0xBA: execTsx,
+	0xBB: execLas,
 	0xBC: execLdy,
 	0xBD: execLda,
 	0xBE: execLdx,
+	0xBF: execLax,
 	0xC0: execCpy,
 	0xC1: execCmp,
+	0xC2: execNop,
+	0xC3: execDcp,
 	0xC4: execCpy,
 	0xC5: execCmp,
 	0xC6: execDec,
+	0xC7: execDcp,
 	0xC8: execIny,
 	0xC9: execCmp,
 	0xCA: execDex,
+	0xCB: execAxs,
 	0xCC: execCpy,
 	0xCD: execCmp,
 	0xCE: execDec,
+	0xCF: execDcp,
 	0xD0: execBne,
 	0xD1: execCmp,
+	0xD2: execKil,
+	0xD3: execDcp,
+	0xD4: execNop,
 	0xD5: execCmp,
 	0xD6: execDec,
+	0xD7: execDcp,
 	0xD8: execCld,
 	0xD9: execCmp,
+	0xDA: execNop,
+	0xDB: execDcp,
+	0xDC: execNop,
 	0xDD: execCmp,
 	0xDE: execDec,
+	0xDF: execDcp,
 	0xE0: execCpx,
 	0xE1: execSbc,
+	0xE2: execNop,
+	0xE3: execIsc,
 	0xE4: execCpx,
 	0xE5: execSbc,
 	0xE6: execInc,
+	0xE7: execIsc,
 	0xE8: execInx,
 	0xE9: execSbc,
 	0xEA: execNop,
+	0xEB: execSbc,
 	0xEC: execCpx,
 	0xED: execSbc,
 	0xEE: execInc,
+	0xEF: execIsc,
 	0xF0: execBeq,
 	0xF1: execSbc,
+	0xF2: execKil,
+	0xF3: execIsc,
+	0xF4: execNop,
 	0xF5: execSbc,
 	0xF6: execInc,
+	0xF7: execIsc,
 	0xF8: execSed,
 	0xF9: execSbc,
+	0xFA: execNop,
+	0xFB: execIsc,
+	0xFC: execNop,
 	0xFD: execSbc,
 	0xFE: execInc,
+	0xFF: execIsc,
+}
+
+// Inst is an opcode decoded once at startup: its parameters, the
+// operations of its addressing mode and its handler, so dispatching an
+// instruction is a single array index.
+type Inst struct {
+	InstParams
+	ops     *ModeOps
+	handler InstHandler
+}
+
+var decodeTable [256]Inst
+
+func init() {
+	for opc := range decodeTable {
+		inst := &decodeTable[opc]
+		inst.InstParams = instTable[opc]
+		inst.ops = &modeOpsTable[inst.mode]
+		inst.handler = instHandlerTable[opc]
+	}
 }
 
 type Cpu struct {
@@ -395,10 +634,28 @@ type Cpu struct {
 	s          uint8
 	p          uint8
 	pc         uint16
-	nmiLatched bool
-	nes        *Nes
-	mem        *MainMemory
-}
+	irqPending bool
+	iDelayed   bool
+	extraCycle uint
+	inst       *Inst
+	oamDma     bool
+	cycles     uint64
+	bus        Bus
+	traceHook  func(cpu *Cpu)
+	intrHook   func(cpu *Cpu, vector uint16)
+	profiler   *Profiler
+}
+
+// IrqSource identifies a device driving the shared /IRQ line. The line is
+// level-triggered: it stays asserted while any source holds it.
+type IrqSource uint
+
+const (
+	IrqSourceApuFrame IrqSource = 1 << iota
+	IrqSourceDmc
+	IrqSourceMapper
+	IrqSourceExternal
+)
 
 type Memory interface {
 	Read8(uint16) uint8
@@ -411,14 +668,64 @@ type Memory interface {
 	Write16NoTrace(uint16, uint16)
 }
 
+// Bus is what the CPU core needs from the system it is plugged into.
+// Peek8 reads without side effects for disassembly and traces, and Tick
+// is called after every instruction or interrupt with the CPU cycles it
+// took, so the rest of the system can catch up. TakeNmi returns and
+// clears a pending NMI edge and Irq the sources holding /IRQ, which
+// devices drive through the bus, usually with an embedded InterruptLines.
+type Bus interface {
+	Memory
+	Peek8(uint16) uint8
+	Tick(cycle uint)
+	TakeNmi() bool
+	Irq() IrqSource
+}
+
+// InterruptLines keeps the /NMI and /IRQ lines of a Bus.
+type InterruptLines struct {
+	nmi bool
+	irq IrqSource
+}
+
+// SetNmi signals an NMI edge, which the CPU takes before the next
+// instruction.
+func (l *InterruptLines) SetNmi() {
+	l.nmi = true
+}
+
+func (l *InterruptLines) AssertIrq(src IrqSource) {
+	l.irq |= src
+}
+
+func (l *InterruptLines) ReleaseIrq(src IrqSource) {
+	l.irq &= ^src
+}
+
+func (l *InterruptLines) TakeNmi() bool {
+	nmi := l.nmi
+	l.nmi = false
+	return nmi
+}
+
+func (l *InterruptLines) Irq() IrqSource {
+	return l.irq
+}
+
 func (c *Cpu) Reset() {
 	c.a = 0
 	c.x = 0
 	c.y = 0
 	c.s = 0xfd
-	c.p = 0x34
-	c.pc = c.nes.mem.Read16(VEC_RESET)
-	Debug("reset vector = %x\n", c.nes.mem.Read16(VEC_RESET))
+	c.p = P_R | P_I
+	c.bus.TakeNmi()
+	c.irqPending = false
+	c.iDelayed = false
+	c.oamDma = false
+	c.cycles = resetCycle
+	c.pc = c.bus.Read16(VEC_RESET)
+	Debug("reset vector = %x\n", c.pc)
+	c.bus.Tick(resetCycle)
 }
 
 func (c *Cpu) Regdump() {
@@ -432,14 +739,17 @@ func (c *Cpu) Regdump() {
 
 const stackBase = 0x100
 
+// The reset sequence takes as long as an interrupt
+const resetCycle = interruptCycle
+
 func (cpu *Cpu) push8(v uint8) {
-	cpu.mem.Write8(stackBase+uint16(cpu.s), v)
+	cpu.bus.Write8(stackBase+uint16(cpu.s), v)
 	cpu.s--
 }
 
 func (cpu *Cpu) pop8() uint8 {
 	cpu.s++
-	return cpu.mem.Read8NoTrace(stackBase + uint16(cpu.s))
+	return cpu.bus.Read8NoTrace(stackBase + uint16(cpu.s))
 }
 
 func (cpu *Cpu) push16(v uint16) {
@@ -466,7 +776,7 @@ func getOpdstrAcc(mem Memory, pc uint16) string {
 }
 
 func getValueImm(cpu *Cpu) uint8 {
-	return cpu.mem.Read8NoTrace(cpu.pc + 1)
+	return cpu.bus.Read8NoTrace(cpu.pc + 1)
 }
 
 func getOpdstrImm(mem Memory, pc uint16) string {
@@ -482,11 +792,11 @@ func getAddrZrp(cpu *Cpu) uint16 {
 }
 
 func getValueZrp(cpu *Cpu) uint8 {
-	return cpu.mem.Read8(getAddrZrp(cpu))
+	return cpu.bus.Read8(getAddrZrp(cpu))
 }
 
 func setValueZrp(cpu *Cpu, v uint8) {
-	cpu.mem.Write8(getAddrZrp(cpu), v)
+	cpu.bus.Write8(getAddrZrp(cpu), v)
 }
 
 func getOpdstrZrp(mem Memory, pc uint16) string {
@@ -498,11 +808,11 @@ func getAddrZpx(cpu *Cpu) uint16 {
 }
 
 func getValueZpx(cpu *Cpu) uint8 {
-	return cpu.mem.Read8(getAddrZpx(cpu))
+	return cpu.bus.Read8(getAddrZpx(cpu))
 }
 
 func setValueZpx(cpu *Cpu, v uint8) {
-	cpu.mem.Write8(getAddrZpx(cpu), v)
+	cpu.bus.Write8(getAddrZpx(cpu), v)
 }
 
 func getOpdstrZpx(mem Memory, pc uint16) string {
@@ -514,11 +824,11 @@ func getAddrZpy(cpu *Cpu) uint16 {
 }
 
 func getValueZpy(cpu *Cpu) uint8 {
-	return cpu.mem.Read8NoTrace(getAddrZpy(cpu))
+	return cpu.bus.Read8(getAddrZpy(cpu))
 }
 
 func setValueZpy(cpu *Cpu, v uint8) {
-	cpu.mem.Write8(getAddrZpy(cpu), v)
+	cpu.bus.Write8(getAddrZpy(cpu), v)
 }
 
 func getOpdstrZpy(mem Memory, pc uint16) string {
@@ -526,9 +836,9 @@ func getOpdstrZpy(mem Memory, pc uint16) string {
 }
 
 func getAddrInd(cpu *Cpu) uint16 {
-	a := cpu.mem.Read16NoTrace(cpu.pc + 1)
-	lo := cpu.mem.Read8NoTrace(a)
-	hi := cpu.mem.Read8NoTrace(a&0xff00 | uint16(uint8(a&0x0ff)+1))
+	a := cpu.bus.Read16NoTrace(cpu.pc + 1)
+	lo := cpu.bus.Read8NoTrace(a)
+	hi := cpu.bus.Read8NoTrace(a&0xff00 | uint16(uint8(a&0x0ff)+1))
 	return uint16(hi)<<8 | uint16(lo)
 }
 
@@ -536,16 +846,35 @@ func getOpdstrInd(mem Memory, pc uint16) string {
 	return fmt.Sprintf("($%04X)", mem.Read16NoTrace(pc+1))
 }
 
+// readIndexed reads an indexed operand. The low byte of the address is
+// added first, so when the index carries into the high byte the CPU reads
+// the wrong page once and spends an extra cycle fixing it up.
+func (cpu *Cpu) readIndexed(a uint16, index uint8) uint8 {
+	if (a-uint16(index))>>8 != a>>8 {
+		cpu.dummyReadIndexed(a, index)
+		cpu.extraCycle = 1
+	}
+	return cpu.bus.Read8(a)
+}
+
+// dummyReadIndexed issues the read from the not yet fixed-up address that
+// stores and read-modify-write instructions always perform. The program
+// never uses the value, so it is not traced or logged as data.
+func (cpu *Cpu) dummyReadIndexed(a uint16, index uint8) {
+	base := a - uint16(index)
+	cpu.bus.Read8NoTrace(base&0xff00 | a&0x00ff)
+}
+
 func getAddrAbs(cpu *Cpu) uint16 {
-	return cpu.mem.Read16NoTrace(cpu.pc + 1)
+	return cpu.bus.Read16NoTrace(cpu.pc + 1)
 }
 
 func getValueAbs(cpu *Cpu) uint8 {
-	return cpu.mem.Read8NoTrace(getAddrAbs(cpu))
+	return cpu.bus.Read8(getAddrAbs(cpu))
 }
 
 func setValueAbs(cpu *Cpu, v uint8) {
-	cpu.mem.Write8(getAddrAbs(cpu), v)
+	cpu.bus.Write8(getAddrAbs(cpu), v)
 }
 
 func getOpdstrAbs(mem Memory, pc uint16) string {
@@ -553,15 +882,17 @@ func getOpdstrAbs(mem Memory, pc uint16) string {
 }
 
 func getAddrAbx(cpu *Cpu) uint16 {
-	return cpu.mem.Read16NoTrace(cpu.pc+1) + uint16(cpu.x)
+	return cpu.bus.Read16NoTrace(cpu.pc+1) + uint16(cpu.x)
 }
 
 func getValueAbx(cpu *Cpu) uint8 {
-	return cpu.mem.Read8(getAddrAbx(cpu))
+	return cpu.readIndexed(getAddrAbx(cpu), cpu.x)
 }
 
 func setValueAbx(cpu *Cpu, v uint8) {
-	cpu.mem.Write8(getAddrAbx(cpu), v)
+	a := getAddrAbx(cpu)
+	cpu.dummyReadIndexed(a, cpu.x)
+	cpu.bus.Write8(a, v)
 }
 
 func getOpdstrAbx(mem Memory, pc uint16) string {
@@ -569,15 +900,17 @@ func getOpdstrAbx(mem Memory, pc uint16) string {
 }
 
 func getAddrAby(cpu *Cpu) uint16 {
-	return cpu.mem.Read16NoTrace(cpu.pc+1) + uint16(cpu.y)
+	return cpu.bus.Read16NoTrace(cpu.pc+1) + uint16(cpu.y)
 }
 
 func getValueAby(cpu *Cpu) uint8 {
-	return cpu.mem.Read8(getAddrAby(cpu))
+	return cpu.readIndexed(getAddrAby(cpu), cpu.y)
 }
 
 func setValueAby(cpu *Cpu, v uint8) {
-	cpu.mem.Write8(getAddrAby(cpu), v)
+	a := getAddrAby(cpu)
+	cpu.dummyReadIndexed(a, cpu.y)
+	cpu.bus.Write8(a, v)
 }
 
 func getOpdstrAby(mem Memory, pc uint16) string {
@@ -586,17 +919,17 @@ func getOpdstrAby(mem Memory, pc uint16) string {
 
 func getAddrInx(cpu *Cpu) uint16 {
 	a := getValueImm(cpu) + cpu.x
-	u := uint16(cpu.mem.Read8NoTrace(uint16(a)))
-	u |= uint16(cpu.mem.Read8NoTrace(uint16(a+1))) << 8
+	u := uint16(cpu.bus.Read8NoTrace(uint16(a)))
+	u |= uint16(cpu.bus.Read8NoTrace(uint16(a+1))) << 8
 	return u
 }
 
 func getValueInx(cpu *Cpu) uint8 {
-	return cpu.mem.Read8(getAddrInx(cpu))
+	return cpu.bus.Read8(getAddrInx(cpu))
 }
 
 func setValueInx(cpu *Cpu, v uint8) {
-	cpu.mem.Write8(getAddrInx(cpu), v)
+	cpu.bus.Write8(getAddrInx(cpu), v)
 }
 
 func getOpdstrInx(mem Memory, pc uint16) string {
@@ -605,17 +938,19 @@ func getOpdstrInx(mem Memory, pc uint16) string {
 
 func getAddrIny(cpu *Cpu) uint16 {
 	a := getValueImm(cpu)
-	lo := cpu.mem.Read8NoTrace(uint16(a))
-	hi := cpu.mem.Read8NoTrace(uint16(a + 1))
+	lo := cpu.bus.Read8NoTrace(uint16(a))
+	hi := cpu.bus.Read8NoTrace(uint16(a + 1))
 	return (uint16(hi)<<8 | uint16(lo)) + uint16(cpu.y)
 }
 
 func getValueIny(cpu *Cpu) uint8 {
-	return cpu.mem.Read8(getAddrIny(cpu))
+	return cpu.readIndexed(getAddrIny(cpu), cpu.y)
 }
 
 func setValueIny(cpu *Cpu, v uint8) {
-	cpu.mem.Write8(getAddrIny(cpu), v)
+	a := getAddrIny(cpu)
+	cpu.dummyReadIndexed(a, cpu.y)
+	cpu.bus.Write8(a, v)
 }
 
 func getOpdstrIny(mem Memory, pc uint16) string {
@@ -637,94 +972,126 @@ func updateFlagsNz(v uint8, cpu *Cpu) {
 	}
 }
 
-func execLda(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
-	cpu.a = modeOpsTable[mode].getValue(cpu)
+// rmwRead and rmwWrite implement the bus pattern of read-modify-write
+// instructions: indexed modes always take the dummy read, and the
+// unmodified value is written back before the result.
+func rmwRead(cpu *Cpu, inst *Inst) uint8 {
+	switch inst.mode {
+	case acc:
+		return cpu.a
+	case abx:
+		a := getAddrAbx(cpu)
+		cpu.dummyReadIndexed(a, cpu.x)
+		return cpu.bus.Read8(a)
+	case aby:
+		a := getAddrAby(cpu)
+		cpu.dummyReadIndexed(a, cpu.y)
+		return cpu.bus.Read8(a)
+	case iny:
+		a := getAddrIny(cpu)
+		cpu.dummyReadIndexed(a, cpu.y)
+		return cpu.bus.Read8(a)
+	}
+	return inst.ops.getValue(cpu)
+}
+
+func rmwWrite(cpu *Cpu, inst *Inst, old uint8, v uint8) {
+	if inst.mode == acc {
+		cpu.a = v
+		return
+	}
+	a := inst.ops.getAddress(cpu)
+	cpu.bus.Write8(a, old)
+	cpu.bus.Write8(a, v)
+}
+
+func execLda(cpu *Cpu, inst *Inst) uint {
+	cpu.a = inst.ops.getValue(cpu)
 	updateFlagsNz(cpu.a, cpu)
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execLdx(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
-	cpu.x = modeOpsTable[mode].getValue(cpu)
+func execLdx(cpu *Cpu, inst *Inst) uint {
+	cpu.x = inst.ops.getValue(cpu)
 	updateFlagsNz(cpu.x, cpu)
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execLdy(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
-	cpu.y = modeOpsTable[mode].getValue(cpu)
+func execLdy(cpu *Cpu, inst *Inst) uint {
+	cpu.y = inst.ops.getValue(cpu)
 	updateFlagsNz(cpu.y, cpu)
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execJmp(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
-	cpu.pc = modeOpsTable[mode].getAddress(cpu)
-	return instTable[opc].cycle
+func execJmp(cpu *Cpu, inst *Inst) uint {
+	cpu.pc = inst.ops.getAddress(cpu)
+	return inst.cycle
 }
 
-func execSta(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
-	modeOpsTable[mode].setValue(cpu, cpu.a)
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+func execSta(cpu *Cpu, inst *Inst) uint {
+	inst.ops.setValue(cpu, cpu.a)
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execStx(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
-	modeOpsTable[mode].setValue(cpu, cpu.x)
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+func execStx(cpu *Cpu, inst *Inst) uint {
+	inst.ops.setValue(cpu, cpu.x)
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execSty(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
-	modeOpsTable[mode].setValue(cpu, cpu.y)
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+func execSty(cpu *Cpu, inst *Inst) uint {
+	inst.ops.setValue(cpu, cpu.y)
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execTax(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
+func execTax(cpu *Cpu, inst *Inst) uint {
 	cpu.x = cpu.a
 	updateFlagsNz(cpu.x, cpu)
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execTxa(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
+func execTxa(cpu *Cpu, inst *Inst) uint {
 	cpu.a = cpu.x
 	updateFlagsNz(cpu.a, cpu)
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execTxs(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
+func execTxs(cpu *Cpu, inst *Inst) uint {
 	cpu.s = cpu.x
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execTsx(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
+func execTsx(cpu *Cpu, inst *Inst) uint {
 	cpu.x = cpu.s
 	updateFlagsNz(cpu.x, cpu)
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execTya(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
+func execTya(cpu *Cpu, inst *Inst) uint {
 	cpu.a = cpu.y
 	updateFlagsNz(cpu.a, cpu)
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execTay(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
+func execTay(cpu *Cpu, inst *Inst) uint {
 	cpu.y = cpu.a
 	updateFlagsNz(cpu.y, cpu)
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execAdc(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
+func adcGen(m uint8, cpu *Cpu) {
 	aPrev := cpu.a
-	m := modeOpsTable[mode].getValue(cpu)
 	u := uint16(cpu.a) + uint16(m) + uint16(cpu.p&P_C)
 	v := int(int8(aPrev)) + int(int8(m)) + int(cpu.p&P_C)
 	cpu.a = uint8(u)
@@ -737,35 +1104,39 @@ func execAdc(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
 		cpu.p |= P_V
 	}
 	updateFlagsNz(cpu.a, cpu)
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
 }
 
-func execAnd(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
-	v := modeOpsTable[mode].getValue(cpu)
+func execAdc(cpu *Cpu, inst *Inst) uint {
+	adcGen(inst.ops.getValue(cpu), cpu)
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
+}
+
+func execAnd(cpu *Cpu, inst *Inst) uint {
+	v := inst.ops.getValue(cpu)
 	cpu.a &= v
 	updateFlagsNz(cpu.a, cpu)
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execAsl(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
-	v := modeOpsTable[mode].getValue(cpu)
-	if (v & 0x80) != 0 {
+func execAsl(cpu *Cpu, inst *Inst) uint {
+	u := rmwRead(cpu, inst)
+	if (u & 0x80) != 0 {
 		cpu.p |= P_C
 	} else {
 		cpu.p &= ^P_C
 	}
-	v <<= 1
-	modeOpsTable[mode].setValue(cpu, v)
+	v := u << 1
+	rmwWrite(cpu, inst, u, v)
 	updateFlagsNz(v, cpu)
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execBit(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
+func execBit(cpu *Cpu, inst *Inst) uint {
 	cpu.p &= ^(P_V | P_N | P_Z)
-	v := modeOpsTable[mode].getValue(cpu)
+	v := inst.ops.getValue(cpu)
 	if v&0x40 != 0 {
 		cpu.p |= P_V
 	}
@@ -775,8 +1146,8 @@ func execBit(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
 	if v&cpu.a == 0 {
 		cpu.p |= P_Z
 	}
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
 func cmpGen(u uint8, v uint8, cpu *Cpu) {
@@ -792,114 +1163,116 @@ func cmpGen(u uint8, v uint8, cpu *Cpu) {
 	}
 }
 
-func execCmp(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
-	m := modeOpsTable[mode].getValue(cpu)
+func execCmp(cpu *Cpu, inst *Inst) uint {
+	m := inst.ops.getValue(cpu)
 	cmpGen(cpu.a, m, cpu)
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execCld(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
+func execCld(cpu *Cpu, inst *Inst) uint {
 	cpu.p &= ^P_D
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execSed(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
+func execSed(cpu *Cpu, inst *Inst) uint {
 	cpu.p |= P_D
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execCpx(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
-	v := modeOpsTable[mode].getValue(cpu)
+func execCpx(cpu *Cpu, inst *Inst) uint {
+	v := inst.ops.getValue(cpu)
 	cmpGen(cpu.x, v, cpu)
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execCpy(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
-	v := modeOpsTable[mode].getValue(cpu)
+func execCpy(cpu *Cpu, inst *Inst) uint {
+	v := inst.ops.getValue(cpu)
 	cmpGen(cpu.y, v, cpu)
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execDec(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
-	v := modeOpsTable[mode].getValue(cpu) - 1
-	modeOpsTable[mode].setValue(cpu, v)
+func execDec(cpu *Cpu, inst *Inst) uint {
+	u := rmwRead(cpu, inst)
+	v := u - 1
+	rmwWrite(cpu, inst, u, v)
 	updateFlagsNz(v, cpu)
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execDex(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
+func execDex(cpu *Cpu, inst *Inst) uint {
 	cpu.x--
 	updateFlagsNz(cpu.x, cpu)
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execDey(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
+func execDey(cpu *Cpu, inst *Inst) uint {
 	cpu.y--
 	updateFlagsNz(cpu.y, cpu)
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execInc(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
-	v := modeOpsTable[mode].getValue(cpu) + 1
-	modeOpsTable[mode].setValue(cpu, v)
+func execInc(cpu *Cpu, inst *Inst) uint {
+	u := rmwRead(cpu, inst)
+	v := u + 1
+	rmwWrite(cpu, inst, u, v)
 	updateFlagsNz(v, cpu)
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execInx(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
+func execInx(cpu *Cpu, inst *Inst) uint {
 	cpu.x++
 	updateFlagsNz(cpu.x, cpu)
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execIny(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
+func execIny(cpu *Cpu, inst *Inst) uint {
 	cpu.y++
 	updateFlagsNz(cpu.y, cpu)
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execEor(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
-	cpu.a ^= modeOpsTable[mode].getValue(cpu)
+func execEor(cpu *Cpu, inst *Inst) uint {
+	cpu.a ^= inst.ops.getValue(cpu)
 	updateFlagsNz(cpu.a, cpu)
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execLsr(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
-	u := modeOpsTable[mode].getValue(cpu)
+func execLsr(cpu *Cpu, inst *Inst) uint {
+	u := rmwRead(cpu, inst)
 	v := u >> 1
 	cpu.p &= ^(P_C | P_Z | P_N)
 	if u&0x01 != 0 {
 		cpu.p |= P_C
 	}
-	modeOpsTable[mode].setValue(cpu, v)
+	rmwWrite(cpu, inst, u, v)
 	updateFlagsNz(v, cpu)
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execOra(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
-	v := modeOpsTable[mode].getValue(cpu)
+func execOra(cpu *Cpu, inst *Inst) uint {
+	v := inst.ops.getValue(cpu)
 	cpu.a |= v
 	updateFlagsNz(cpu.a, cpu)
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execRol(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
+func execRol(cpu *Cpu, inst *Inst) uint {
 	oldCarry := cpu.p & P_C
-	u := modeOpsTable[mode].getValue(cpu)
+	u := rmwRead(cpu, inst)
 	v := u << 1
 	if oldCarry != 0 {
 		v |= 0x01
@@ -912,17 +1285,17 @@ func execRol(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
 	if v&0x80 != 0 {
 		cpu.p |= P_N
 	}
-	modeOpsTable[mode].setValue(cpu, v)
+	rmwWrite(cpu, inst, u, v)
 	cpu.p &= ^P_Z
-	if cpu.a == 0 {
+	if v == 0 {
 		cpu.p |= P_Z
 	}
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execRor(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
-	u := modeOpsTable[mode].getValue(cpu)
+func execRor(cpu *Cpu, inst *Inst) uint {
+	u := rmwRead(cpu, inst)
 	v := u >> 1
 	if cpu.p&P_C != 0 {
 		v |= 0x80
@@ -934,210 +1307,530 @@ func execRor(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
 	if v&0x80 != 0 {
 		cpu.p |= P_N
 	}
-	modeOpsTable[mode].setValue(cpu, v)
-	if cpu.a == 0 {
+	rmwWrite(cpu, inst, u, v)
+	if v == 0 {
 		cpu.p |= P_Z
 	}
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execSbc(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
-	aPrev := cpu.a
-	m := modeOpsTable[mode].getValue(cpu)
-	v := m + (1 - cpu.p&P_C)
-	cpu.a = cpu.a - v
-	u := int(int8(aPrev)) - int(int8(m)) - int(1-cpu.p&P_C)
-	cpu.p &= ^(P_C | P_V)
-	if aPrev >= v {
-		cpu.p |= P_C
-	}
-	if u < -128 || u > 127 {
-		cpu.p |= P_V
-	}
-	updateFlagsNz(cpu.a, cpu)
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+func sbcGen(m uint8, cpu *Cpu) {
+	// A - M - (1 - C) is A + ^M + C in two's complement
+	adcGen(^m, cpu)
+}
+
+func execSbc(cpu *Cpu, inst *Inst) uint {
+	sbcGen(inst.ops.getValue(cpu), cpu)
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execPha(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
+func execPha(cpu *Cpu, inst *Inst) uint {
 	cpu.push8(cpu.a)
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execPhp(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
-	cpu.push8(cpu.p)
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+func execPhp(cpu *Cpu, inst *Inst) uint {
+	cpu.push8(cpu.p | P_B | P_R)
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execPla(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
+func execPla(cpu *Cpu, inst *Inst) uint {
 	cpu.a = cpu.pop8()
 	updateFlagsNz(cpu.a, cpu)
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execPlp(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
-	cpu.p = cpu.pop8() | P_R
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+func execPlp(cpu *Cpu, inst *Inst) uint {
+	cpu.p = cpu.pop8()&^P_B | P_R
+	cpu.iDelayed = true
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execJsr(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
+func execJsr(cpu *Cpu, inst *Inst) uint {
 	cpu.push16(uint16(cpu.pc + 2))
 	cpu.pc = getAddrAbs(cpu)
-	return instTable[opc].cycle
+	return inst.cycle
 }
 
-func execRts(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
+func execRts(cpu *Cpu, inst *Inst) uint {
 	cpu.pc = cpu.pop16()
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execRti(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
-	cpu.p = cpu.pop8() | P_R
+func execRti(cpu *Cpu, inst *Inst) uint {
+	cpu.p = cpu.pop8()&^P_B | P_R
 	cpu.pc = cpu.pop16()
-	return instTable[opc].cycle
+	return inst.cycle
 }
 
-func execBranchGen(cpu *Cpu, opc uint8, mode InstMode, bytes uint, v bool) uint {
+func execBranchGen(cpu *Cpu, inst *Inst, v bool) uint {
 	var extracycle uint = 0
 	if v {
 		extracycle = 1
-		nextpc := cpu.pc + uint16(bytes)
+		nextpc := cpu.pc + uint16(inst.bytes)
 		cpu.pc = uint16(int(nextpc) + int(int8(getValueImm(cpu))))
 		if nextpc>>8 != cpu.pc>>8 {
 			extracycle = 2
 		}
 	} else {
-		cpu.pc += uint16(bytes)
+		cpu.pc += uint16(inst.bytes)
 	}
-	return instTable[opc].cycle + extracycle
+	return inst.cycle + extracycle
 }
 
-func execBmi(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
-	return execBranchGen(cpu, opc, mode, bytes, cpu.p&P_N != 0)
+func execBmi(cpu *Cpu, inst *Inst) uint {
+	return execBranchGen(cpu, inst, cpu.p&P_N != 0)
 }
 
-func execBcc(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
-	return execBranchGen(cpu, opc, mode, bytes, cpu.p&P_C == 0)
+func execBcc(cpu *Cpu, inst *Inst) uint {
+	return execBranchGen(cpu, inst, cpu.p&P_C == 0)
 }
 
-func execBcs(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
-	return execBranchGen(cpu, opc, mode, bytes, cpu.p&P_C != 0)
+func execBcs(cpu *Cpu, inst *Inst) uint {
+	return execBranchGen(cpu, inst, cpu.p&P_C != 0)
 }
 
-func execBeq(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
-	return execBranchGen(cpu, opc, mode, bytes, cpu.p&P_Z != 0)
+func execBeq(cpu *Cpu, inst *Inst) uint {
+	return execBranchGen(cpu, inst, cpu.p&P_Z != 0)
 }
 
-func execBne(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
-	return execBranchGen(cpu, opc, mode, bytes, cpu.p&P_Z == 0)
+func execBne(cpu *Cpu, inst *Inst) uint {
+	return execBranchGen(cpu, inst, cpu.p&P_Z == 0)
 }
 
-func execBpl(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
-	return execBranchGen(cpu, opc, mode, bytes, cpu.p&P_N == 0)
+func execBpl(cpu *Cpu, inst *Inst) uint {
+	return execBranchGen(cpu, inst, cpu.p&P_N == 0)
 }
 
-func execBvc(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
-	return execBranchGen(cpu, opc, mode, bytes, cpu.p&P_V == 0)
+func execBvc(cpu *Cpu, inst *Inst) uint {
+	return execBranchGen(cpu, inst, cpu.p&P_V == 0)
 }
 
-func execBvs(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
-	return execBranchGen(cpu, opc, mode, bytes, cpu.p&P_V != 0)
+func execBvs(cpu *Cpu, inst *Inst) uint {
+	return execBranchGen(cpu, inst, cpu.p&P_V != 0)
 }
 
-func execClc(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
+func execClc(cpu *Cpu, inst *Inst) uint {
 	cpu.p &= ^P_C
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execCli(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
+func execCli(cpu *Cpu, inst *Inst) uint {
 	cpu.p &= ^P_I
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+	cpu.iDelayed = true
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execClv(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
+func execClv(cpu *Cpu, inst *Inst) uint {
 	cpu.p &= ^P_V
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execSec(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
+func execSec(cpu *Cpu, inst *Inst) uint {
 	cpu.p |= P_C
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execSei(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
+func execSei(cpu *Cpu, inst *Inst) uint {
 	cpu.p |= P_I
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+	cpu.iDelayed = true
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
+}
+
+func execBrk(cpu *Cpu, inst *Inst) uint {
+	// BRK skips a padding byte after the opcode
+	cpu.push16(cpu.pc + 2)
+	cpu.push8(cpu.p | P_B | P_R)
+	cpu.p |= P_I
+	cpu.pc = cpu.bus.Read16(VEC_IRQ)
+	return inst.cycle
+}
+
+func execNop(cpu *Cpu, inst *Inst) uint {
+	// Unofficial NOPs with a memory operand still read it
+	if getValue := inst.ops.getValue; getValue != nil {
+		getValue(cpu)
+	}
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
+}
+
+//
+// Unofficial opcodes
+//
+
+func execKil(cpu *Cpu, inst *Inst) uint {
+	// The CPU locks up; keep fetching the same opcode until reset
+	return inst.cycle
+}
+
+func execLax(cpu *Cpu, inst *Inst) uint {
+	cpu.a = inst.ops.getValue(cpu)
+	cpu.x = cpu.a
+	updateFlagsNz(cpu.a, cpu)
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
+}
+
+func execLxa(cpu *Cpu, inst *Inst) uint {
+	cpu.a = (cpu.a | 0xff) & inst.ops.getValue(cpu)
+	cpu.x = cpu.a
+	updateFlagsNz(cpu.a, cpu)
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
 }
 
-func execBrk(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
+func execSax(cpu *Cpu, inst *Inst) uint {
+	inst.ops.setValue(cpu, cpu.a&cpu.x)
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
+}
+
+func execDcp(cpu *Cpu, inst *Inst) uint {
+	u := rmwRead(cpu, inst)
+	v := u - 1
+	rmwWrite(cpu, inst, u, v)
+	cmpGen(cpu.a, v, cpu)
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
+}
+
+func execIsc(cpu *Cpu, inst *Inst) uint {
+	u := rmwRead(cpu, inst)
+	v := u + 1
+	rmwWrite(cpu, inst, u, v)
+	sbcGen(v, cpu)
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
+}
+
+func execSlo(cpu *Cpu, inst *Inst) uint {
+	u := rmwRead(cpu, inst)
+	v := u << 1
+	cpu.p &= ^P_C
+	if u&0x80 != 0 {
+		cpu.p |= P_C
+	}
+	rmwWrite(cpu, inst, u, v)
+	cpu.a |= v
+	updateFlagsNz(cpu.a, cpu)
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
+}
+
+func execRla(cpu *Cpu, inst *Inst) uint {
+	u := rmwRead(cpu, inst)
+	v := u<<1 | cpu.p&P_C
+	cpu.p &= ^P_C
+	if u&0x80 != 0 {
+		cpu.p |= P_C
+	}
+	rmwWrite(cpu, inst, u, v)
+	cpu.a &= v
+	updateFlagsNz(cpu.a, cpu)
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
+}
+
+func execSre(cpu *Cpu, inst *Inst) uint {
+	u := rmwRead(cpu, inst)
+	v := u >> 1
+	cpu.p &= ^P_C
+	if u&0x01 != 0 {
+		cpu.p |= P_C
+	}
+	rmwWrite(cpu, inst, u, v)
+	cpu.a ^= v
+	updateFlagsNz(cpu.a, cpu)
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
+}
+
+func execRra(cpu *Cpu, inst *Inst) uint {
+	u := rmwRead(cpu, inst)
+	v := u >> 1
+	if cpu.p&P_C != 0 {
+		v |= 0x80
+	}
+	cpu.p &= ^P_C
+	if u&0x01 != 0 {
+		cpu.p |= P_C
+	}
+	rmwWrite(cpu, inst, u, v)
+	adcGen(v, cpu)
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
+}
+
+func execAnc(cpu *Cpu, inst *Inst) uint {
+	cpu.a &= inst.ops.getValue(cpu)
+	updateFlagsNz(cpu.a, cpu)
+	cpu.p &= ^P_C
+	if cpu.a&0x80 != 0 {
+		cpu.p |= P_C
+	}
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
+}
+
+func execAlr(cpu *Cpu, inst *Inst) uint {
+	u := cpu.a & inst.ops.getValue(cpu)
+	cpu.a = u >> 1
+	cpu.p &= ^P_C
+	if u&0x01 != 0 {
+		cpu.p |= P_C
+	}
+	updateFlagsNz(cpu.a, cpu)
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
+}
+
+func execArr(cpu *Cpu, inst *Inst) uint {
+	u := cpu.a & inst.ops.getValue(cpu)
+	cpu.a = u >> 1
+	if cpu.p&P_C != 0 {
+		cpu.a |= 0x80
+	}
+	updateFlagsNz(cpu.a, cpu)
+	cpu.p &= ^(P_C | P_V)
+	if cpu.a&0x40 != 0 {
+		cpu.p |= P_C
+	}
+	if (cpu.a>>6^cpu.a>>5)&0x01 != 0 {
+		cpu.p |= P_V
+	}
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
+}
+
+func execAxs(cpu *Cpu, inst *Inst) uint {
+	m := inst.ops.getValue(cpu)
+	u := cpu.a & cpu.x
+	cpu.x = u - m
+	cpu.p &= ^P_C
+	if u >= m {
+		cpu.p |= P_C
+	}
+	updateFlagsNz(cpu.x, cpu)
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
+}
+
+func execXaa(cpu *Cpu, inst *Inst) uint {
+	cpu.a = (cpu.a | 0xee) & cpu.x & inst.ops.getValue(cpu)
+	updateFlagsNz(cpu.a, cpu)
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
+}
+
+func execLas(cpu *Cpu, inst *Inst) uint {
+	v := inst.ops.getValue(cpu) & cpu.s
+	cpu.a = v
+	cpu.x = v
+	cpu.s = v
+	updateFlagsNz(v, cpu)
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
+}
+
+// storeHighAndGen stores v ANDed with the high byte of the base address
+// plus one. When indexing crosses a page the stored value also replaces
+// the high byte of the target address.
+func storeHighAndGen(cpu *Cpu, inst *Inst, index uint8, v uint8) {
+	addr := inst.ops.getAddress(cpu)
+	base := addr - uint16(index)
+	v &= uint8(base>>8) + 1
+	cpu.dummyReadIndexed(addr, index)
+	if base>>8 != addr>>8 {
+		addr = uint16(v)<<8 | addr&0x00ff
+	}
+	cpu.bus.Write8(addr, v)
+}
+
+func execAhx(cpu *Cpu, inst *Inst) uint {
+	storeHighAndGen(cpu, inst, cpu.y, cpu.a&cpu.x)
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
+}
+
+func execShx(cpu *Cpu, inst *Inst) uint {
+	storeHighAndGen(cpu, inst, cpu.y, cpu.x)
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
+}
+
+func execShy(cpu *Cpu, inst *Inst) uint {
+	storeHighAndGen(cpu, inst, cpu.x, cpu.y)
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
+}
+
+func execTas(cpu *Cpu, inst *Inst) uint {
+	cpu.s = cpu.a & cpu.x
+	storeHighAndGen(cpu, inst, cpu.y, cpu.s)
+	cpu.pc += uint16(inst.bytes)
+	return inst.cycle
+}
+
+const interruptCycle = 7
+
+func (cpu *Cpu) interrupt(vector uint16) uint {
+	if cpu.intrHook != nil {
+		cpu.intrHook(cpu, vector)
+	}
 	cpu.push16(cpu.pc)
-	cpu.push8(cpu.p)
-	cpu.pc = cpu.mem.Read16(VEC_IRQ)
-	cpu.p |= P_B
-	return instTable[opc].cycle
+	cpu.push8(cpu.p&^P_B | P_R)
+	cpu.p |= P_I
+	cpu.pc = cpu.bus.Read16(vector)
+	if cpu.profiler != nil {
+		cpu.profiler.interrupt(cpu, vector)
+	}
+	return interruptCycle
 }
 
-func execNop(cpu *Cpu, opc uint8, mode InstMode, bytes uint) uint {
-	cpu.pc += uint16(bytes)
-	return instTable[opc].cycle
+const oamDmaCycle = 513
+
+// startOamDma is called on a write to $4014. The CPU is halted while the
+// DMA unit copies 256 bytes, one read and one write cycle per byte, after
+// a halt cycle and an alignment cycle when the DMA starts on an odd cycle.
+func (cpu *Cpu) startOamDma() {
+	cpu.oamDma = true
 }
 
-func (cpu *Cpu) setNmi() {
-	cpu.nmiLatched = true
+func (cpu *Cpu) oamDmaStall(cycle uint) uint {
+	cpu.oamDma = false
+	if (cpu.cycles+uint64(cycle))&1 != 0 {
+		return oamDmaCycle + 1
+	}
+	return oamDmaCycle
 }
 
-func (cpu *Cpu) executeInst() uint {
-	if cpu.nmiLatched {
-		//Debug("NMI latched\n")
-		cpu.nmiLatched = false
-		cpu.push16(cpu.pc)
-		cpu.push8(cpu.p)
-		cpu.pc = cpu.mem.Read16(VEC_NMI)
+// pollIrq samples the IRQ line at the end of an instruction. CLI, SEI and
+// PLP change I after the poll, so their effect is delayed by one
+// instruction.
+func (cpu *Cpu) pollIrq(pPrev uint8) {
+	p := cpu.p
+	if cpu.iDelayed {
+		p = pPrev
+		cpu.iDelayed = false
 	}
+	cpu.irqPending = cpu.bus.Irq() != 0 && p&P_I == 0
+}
 
-	opc := cpu.mem.Read8NoTrace(cpu.pc)
-	mode := instTable[opc].mode
-	bytes := instTable[opc].bytes
-	if cpu.nes.dbg.trace {
-		Debug("%04X: %s %-10s    opc=%02Xh A:%02X X:%02X Y:%02X P:%02X SP:%02X\n",
-			cpu.pc, instTable[opc].mnemonic,
-			modeOpsTable[mode].getOpdString(cpu.mem, cpu.pc),
-			opc, cpu.a, cpu.x, cpu.y, cpu.p, cpu.s)
+// Step executes one instruction, or enters a pending interrupt, and
+// returns the CPU cycles it took.
+func (cpu *Cpu) Step() uint {
+	return cpu.executeInst()
+}
+
+// accessCycle returns the cycles of the current instruction that come
+// before its memory access. Data accesses take the last cycle of an
+// instruction.
+func (cpu *Cpu) accessCycle() uint {
+	if cpu.inst == nil {
+		return 0
 	}
-	cycle := instHandlerTable[opc](cpu, opc, mode, bytes)
+	return cpu.inst.cycle + cpu.extraCycle - 1
+}
 
+func (cpu *Cpu) executeInst() uint {
+	cycle := cpu.dispatch()
+	cpu.cycles += uint64(cycle)
+	cpu.bus.Tick(cycle)
 	return cycle
 }
 
-func GetAsmStr(mem Memory, pc uint16) (error, int, string) {
-	opc := mem.Read8NoTrace(pc)
-	_, ok := instTable[opc]
-	if !ok {
-		return errors.New("invalid opcode"), 0, "invalid opcode"
+func (cpu *Cpu) dispatch() uint {
+	if cpu.profiler != nil {
+		cpu.profiler.account(cpu)
+	}
+	if cpu.bus.TakeNmi() {
+		//Debug("NMI latched\n")
+		cpu.irqPending = false
+		return cpu.interrupt(VEC_NMI)
+	}
+	if cpu.irqPending {
+		cpu.irqPending = false
+		return cpu.interrupt(VEC_IRQ)
 	}
 
-	mode := instTable[opc].mode
-	s := fmt.Sprintf("%04X: %s %-10s",
-		pc,
-		instTable[opc].mnemonic,
-		modeOpsTable[mode].getOpdString(mem, pc))
-	return nil, int(instTable[opc].bytes), s
+	inst := &decodeTable[cpu.bus.Read8NoTrace(cpu.pc)]
+	if cpu.traceHook != nil {
+		cpu.traceHook(cpu)
+	}
+	if cpu.profiler != nil {
+		cpu.profiler.inst(cpu, inst)
+	}
+	pPrev := cpu.p
+	cpu.extraCycle = 0
+	cpu.inst = inst
+	cycle := inst.handler(cpu, inst) + cpu.extraCycle
+	cpu.inst = nil
+	cpu.pollIrq(pPrev)
+	if cpu.oamDma {
+		cycle += cpu.oamDmaStall(cycle)
+	}
+
+	return cycle
 }
 
-func NewCpu(nes *Nes) *Cpu {
+func GetAsmStr(mem Memory, pc uint16) (error, int, string) {
+	inst := &decodeTable[mem.Read8NoTrace(pc)]
+	s := fmt.Sprintf("%04X:%c%s %-10s",
+		pc,
+		inst.marker(),
+		inst.mnemonic,
+		inst.ops.getOpdString(mem, pc))
+	return nil, int(inst.bytes), s
+}
+
+// SetTraceHook installs a function called before every instruction is
+// executed, or removes it when f is nil.
+func (cpu *Cpu) SetTraceHook(f func(cpu *Cpu)) {
+	cpu.traceHook = f
+}
+
+// SetInterruptHook installs a function called when the CPU enters an NMI
+// or IRQ handler, before the vector is read.
+func (cpu *Cpu) SetInterruptHook(f func(cpu *Cpu, vector uint16)) {
+	cpu.intrHook = f
+}
+
+// SetProfiler attaches a profiler, or detaches it when prof is nil.
+func (cpu *Cpu) SetProfiler(prof *Profiler) {
+	cpu.profiler = prof
+}
+
+func (cpu *Cpu) A() uint8        { return cpu.a }
+func (cpu *Cpu) X() uint8        { return cpu.x }
+func (cpu *Cpu) Y() uint8        { return cpu.y }
+func (cpu *Cpu) S() uint8        { return cpu.s }
+func (cpu *Cpu) P() uint8        { return cpu.p }
+func (cpu *Cpu) PC() uint16      { return cpu.pc }
+func (cpu *Cpu) Cycles() uint64  { return cpu.cycles }
+func (cpu *Cpu) SetA(v uint8)    { cpu.a = v }
+func (cpu *Cpu) SetX(v uint8)    { cpu.x = v }
+func (cpu *Cpu) SetY(v uint8)    { cpu.y = v }
+func (cpu *Cpu) SetS(v uint8)    { cpu.s = v }
+func (cpu *Cpu) SetP(v uint8)    { cpu.p = v&^P_B | P_R }
+func (cpu *Cpu) SetPC(pc uint16) { cpu.pc = pc }
+
+// NewCpu creates a 6502 core attached to bus. Call Reset before the first
+// Step to load PC from the reset vector.
+func NewCpu(bus Bus) *Cpu {
 	cpu := new(Cpu)
-	cpu.nes = nes
-	cpu.mem = nes.mem
+	cpu.bus = bus
 	return cpu
 }
@@ -0,0 +1,831 @@
+package nespkg
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+)
+
+//
+// Frame post-processing
+//
+// A FilterChain turns the screen into an RGBA image, with the palette or
+// the NTSC filter, and passes it through image filters such as scalers.
+// Filters keep their output image and reuse it on the next frame.
+//
+
+type ImageFilter interface {
+	Apply(src *image.RGBA) *image.RGBA
+}
+
+type FilterChain struct {
+	palette *Palette
+	source  FrameFilter
+	filters []ImageFilter
+	im      *image.RGBA
+}
+
+// NewFilterChain makes a chain that converts the screen with pal, or with
+// source when it is not nil, and then runs filters in order.
+func NewFilterChain(pal *Palette, source FrameFilter, filters ...ImageFilter) *FilterChain {
+	c := new(FilterChain)
+	c.palette = pal
+	c.source = source
+	c.filters = filters
+	return c
+}
+
+func (c *FilterChain) Filter(screen *[ScreenSizePixY][ScreenSizePixX]uint16, frame uint64) *image.RGBA {
+	var im *image.RGBA
+	if c.source != nil {
+		im = c.source.Filter(screen, frame)
+	} else {
+		c.im = reuseRGBA(c.im, ScreenSizePixX, ScreenSizePixY)
+		c.palette.ToRGBA(c.im, screen)
+		im = c.im
+	}
+	for _, f := range c.filters {
+		im = f.Apply(im)
+	}
+	return im
+}
+
+func reuseRGBA(im *image.RGBA, w int, h int) *image.RGBA {
+	if im == nil || im.Rect.Dx() != w || im.Rect.Dy() != h {
+		return image.NewRGBA(image.Rect(0, 0, w, h))
+	}
+	return im
+}
+
+// Pixels are handled as packed RGBA to make comparing them cheap.
+type rgbaPixels struct {
+	pix  []uint32
+	w, h int
+}
+
+func (p *rgbaPixels) load(im *image.RGBA) {
+	b := im.Rect
+	p.w = b.Dx()
+	p.h = b.Dy()
+	if cap(p.pix) < p.w*p.h {
+		p.pix = make([]uint32, p.w*p.h)
+	}
+	p.pix = p.pix[:p.w*p.h]
+	for y := 0; y < p.h; y++ {
+		row := im.Pix[y*im.Stride:]
+		for x := 0; x < p.w; x++ {
+			s := row[x*4:]
+			p.pix[y*p.w+x] = uint32(s[0]) | uint32(s[1])<<8 | uint32(s[2])<<16 | uint32(s[3])<<24
+		}
+	}
+}
+
+// at returns the pixel at x, y with the edge pixels repeated outside.
+func (p *rgbaPixels) at(x int, y int) uint32 {
+	if x < 0 {
+		x = 0
+	} else if x >= p.w {
+		x = p.w - 1
+	}
+	if y < 0 {
+		y = 0
+	} else if y >= p.h {
+		y = p.h - 1
+	}
+	return p.pix[y*p.w+x]
+}
+
+func setPixel(im *image.RGBA, x int, y int, c uint32) {
+	s := im.Pix[y*im.Stride+x*4:]
+	s[0] = uint8(c)
+	s[1] = uint8(c >> 8)
+	s[2] = uint8(c >> 16)
+	s[3] = uint8(c >> 24)
+}
+
+// blend2 mixes two colors with integer weights, channel by channel.
+func blend2(c1 uint32, w1 uint32, c2 uint32, w2 uint32) uint32 {
+	total := w1 + w2
+	var out uint32
+	for shift := uint(0); shift < 32; shift += 8 {
+		v := (c1>>shift&0xff)*w1 + (c2>>shift&0xff)*w2
+		out |= v / total << shift
+	}
+	return out
+}
+
+//
+// Overscan crop
+//
+
+// CropFilter removes the edges most TVs hide. The PPU renders garbage
+// there in many games, mostly in the top and bottom 8 lines.
+type CropFilter struct {
+	Top, Bottom, Left, Right int
+	dst                      *image.RGBA
+}
+
+func NewCropFilter(top, bottom, left, right int) *CropFilter {
+	return &CropFilter{Top: top, Bottom: bottom, Left: left, Right: right}
+}
+
+func (f *CropFilter) Apply(src *image.RGBA) *image.RGBA {
+	b := src.Rect
+	w := b.Dx() - f.Left - f.Right
+	h := b.Dy() - f.Top - f.Bottom
+	if w <= 0 || h <= 0 {
+		return src
+	}
+	f.dst = reuseRGBA(f.dst, w, h)
+	for y := 0; y < h; y++ {
+		s := src.Pix[(y+f.Top)*src.Stride+f.Left*4:]
+		copy(f.dst.Pix[y*f.dst.Stride:], s[:w*4])
+	}
+	return f.dst
+}
+
+//
+// Scanlines
+//
+
+// ScanlineFilter darkens every other line by Strength, 0 to 1. Put it after
+// a scaler so that the lines are finer than the pixels.
+type ScanlineFilter struct {
+	Strength float64
+	dst      *image.RGBA
+}
+
+func NewScanlineFilter(strength float64) *ScanlineFilter {
+	return &ScanlineFilter{Strength: strength}
+}
+
+func (f *ScanlineFilter) Apply(src *image.RGBA) *image.RGBA {
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	f.dst = reuseRGBA(f.dst, w, h)
+	keep := uint32((1 - f.Strength) * 256)
+	for y := 0; y < h; y++ {
+		s := src.Pix[y*src.Stride:]
+		d := f.dst.Pix[y*f.dst.Stride:]
+		copy(d[:w*4], s[:w*4])
+		if y%2 == 0 {
+			continue
+		}
+		for x := 0; x < w*4; x++ {
+			if x%4 != 3 {
+				d[x] = uint8(uint32(d[x]) * keep >> 8)
+			}
+		}
+	}
+	return f.dst
+}
+
+//
+// Scale2x and Scale3x
+//
+
+// ScaleNxFilter is the Scale2x/Scale3x (AdvMAME) edge directed scaler. It
+// only copies pixels, so the output has no new colors.
+type ScaleNxFilter struct {
+	Factor int
+	src    rgbaPixels
+	dst    *image.RGBA
+}
+
+func NewScaleNxFilter(factor int) *ScaleNxFilter {
+	return &ScaleNxFilter{Factor: factor}
+}
+
+func (f *ScaleNxFilter) Apply(src *image.RGBA) *image.RGBA {
+	p := &f.src
+	p.load(src)
+	n := f.Factor
+	f.dst = reuseRGBA(f.dst, p.w*n, p.h*n)
+	for y := 0; y < p.h; y++ {
+		for x := 0; x < p.w; x++ {
+			// A B C
+			// D E F
+			// G H I
+			a, b, c := p.at(x-1, y-1), p.at(x, y-1), p.at(x+1, y-1)
+			d, e, ff := p.at(x-1, y), p.at(x, y), p.at(x+1, y)
+			g, h, i := p.at(x-1, y+1), p.at(x, y+1), p.at(x+1, y+1)
+			var out [9]uint32
+			if n == 2 {
+				out = [9]uint32{e, e, e, e}
+				if b != h && d != ff {
+					if d == b {
+						out[0] = d
+					}
+					if b == ff {
+						out[1] = ff
+					}
+					if d == h {
+						out[2] = d
+					}
+					if h == ff {
+						out[3] = ff
+					}
+				}
+			} else {
+				out = [9]uint32{e, e, e, e, e, e, e, e, e}
+				if b != h && d != ff {
+					if d == b {
+						out[0] = d
+					}
+					if (d == b && e != c) || (b == ff && e != a) {
+						out[1] = b
+					}
+					if b == ff {
+						out[2] = ff
+					}
+					if (d == b && e != g) || (d == h && e != a) {
+						out[3] = d
+					}
+					if (b == ff && e != i) || (h == ff && e != c) {
+						out[5] = ff
+					}
+					if d == h {
+						out[6] = d
+					}
+					if (d == h && e != i) || (h == ff && e != g) {
+						out[7] = h
+					}
+					if h == ff {
+						out[8] = ff
+					}
+				}
+			}
+			for j := 0; j < n*n; j++ {
+				setPixel(f.dst, x*n+j%n, y*n+j/n, out[j])
+			}
+		}
+	}
+	return f.dst
+}
+
+//
+// hq2x and hq3x
+//
+// hqx compares each pixel with its eight neighbours in YUV and looks the
+// pattern of those that differ up in a table of interpolation rules, one
+// rule for each output pixel. The four corners are treated alike, so the
+// tables hold the rules of the top left output pixel, and of the top middle
+// one for hq3x, and the other pixels use them with the neighbourhood turned.
+// The neighbours are numbered as in the original code, E being the pixel
+// that is scaled:
+//
+//	w1 w2 w3
+//	w4 E  w6
+//	w7 w8 w9
+//
+// Bit 0 of the pattern is w1 and bit 7 is w9. For the top left pixel the
+// kernels blend E with the corner neighbour Z = w1 and with the neighbours
+// either side of it, X = w4 and Y = w2.
+//
+
+// Colors closer than these thresholds in YUV count as the same for hqx.
+const (
+	yuvThresholdY = 48
+	yuvThresholdU = 7
+	yuvThresholdV = 6
+)
+
+func rgbToYuv(c uint32) (int, int, int) {
+	r := int(c & 0xff)
+	g := int(c >> 8 & 0xff)
+	b := int(c >> 16 & 0xff)
+	y := (r + g + b) >> 2
+	u := 128 + ((r - b) >> 2)
+	v := 128 + ((2*g - r - b) >> 3)
+	return y, u, v
+}
+
+func absInt(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func yuvDiffers(c1 uint32, c2 uint32) bool {
+	if c1 == c2 {
+		return false
+	}
+	y1, u1, v1 := rgbToYuv(c1)
+	y2, u2, v2 := rgbToYuv(c2)
+	return absInt(y1-y2) > yuvThresholdY || absInt(u1-u2) > yuvThresholdU || absInt(v1-v2) > yuvThresholdV
+}
+
+// hqKernel holds the weights of E, Z, X and Y.
+type hqKernel [4]uint32
+
+// The kernels are named after the interpolations of the original code.
+var (
+	hqE   = hqKernel{1, 0, 0, 0}
+	hq10  = hqKernel{3, 1, 0, 0}
+	hq11  = hqKernel{3, 0, 1, 0}
+	hq12  = hqKernel{3, 0, 0, 1}
+	hq20  = hqKernel{2, 0, 1, 1}
+	hq21  = hqKernel{2, 1, 0, 1}
+	hq22  = hqKernel{2, 1, 1, 0}
+	hq60  = hqKernel{5, 0, 1, 2}
+	hq61  = hqKernel{5, 0, 2, 1}
+	hq70  = hqKernel{6, 0, 1, 1}
+	hq90  = hqKernel{2, 0, 3, 3}
+	hq100 = hqKernel{14, 0, 1, 1}
+	// hq3x corners
+	hq4 = hqKernel{2, 0, 7, 7}
+	hq5 = hqKernel{0, 0, 1, 1}
+	// hq3x edges, which blend towards Y
+	hqEdge3 = hqKernel{7, 0, 0, 1}
+	hqEdge6 = hqKernel{1, 0, 0, 3}
+)
+
+func (k *hqKernel) blend(e, z, x, y uint32) uint32 {
+	total := k[0] + k[1] + k[2] + k[3]
+	var out uint32
+	for shift := uint(0); shift < 32; shift += 8 {
+		v := (e>>shift&0xff)*k[0] + (z>>shift&0xff)*k[1] + (x>>shift&0xff)*k[2] + (y>>shift&0xff)*k[3]
+		out |= v / total << shift
+	}
+	return out
+}
+
+// hqCross is the pair of neighbours a rule compares with each other.
+type hqCross int
+
+const (
+	hqCrossNone  hqCross = iota
+	hqCrossXY            // w4 and w2
+	hqCrossYNext         // w2 and w6
+	hqCrossXPrev         // w8 and w4
+)
+
+// hqRule uses the kernel diff when the neighbours of cross differ and the
+// kernel same otherwise.
+type hqRule struct {
+	cross hqCross
+	diff  hqKernel
+	same  hqKernel
+}
+
+// apply works out an output pixel from the neighbourhood n, turned so that
+// the pixel is in the top left corner or on the top edge.
+func (r *hqRule) apply(n *[9]uint32) uint32 {
+	k := &r.same
+	switch r.cross {
+	case hqCrossXY:
+		if yuvDiffers(n[3], n[1]) {
+			k = &r.diff
+		}
+	case hqCrossYNext:
+		if yuvDiffers(n[1], n[5]) {
+			k = &r.diff
+		}
+	case hqCrossXPrev:
+		if yuvDiffers(n[7], n[3]) {
+			k = &r.diff
+		}
+	}
+	return k.blend(n[4], n[0], n[3], n[1])
+}
+
+type hqCase struct {
+	rule     hqRule
+	patterns []uint8
+}
+
+// hq2xCorners gives the rule of the top left output pixel of hq2x.
+var hq2xCorners = []hqCase{
+	{hqRule{hqCrossNone, hq20, hq20}, []uint8{
+		0, 1, 4, 5, 16, 17, 20, 21, 32, 33, 36, 37, 48, 49, 52, 53, 64, 65,
+		68, 69, 80, 81, 84, 85, 96, 97, 100, 101, 112, 113, 116, 117, 128,
+		129, 132, 133, 144, 145, 148, 149, 160, 161, 164, 165, 176, 177, 180,
+		181, 192, 193, 196, 197, 208, 209, 212, 213, 224, 225, 228, 229, 240,
+		241, 244, 245,
+	}},
+	{hqRule{hqCrossNone, hq22, hq22}, []uint8{
+		2, 6, 18, 22, 34, 38, 50, 54, 66, 70, 82, 86, 98, 102, 114, 118, 130,
+		134, 146, 150, 162, 166, 178, 182, 194, 198, 210, 214, 226, 230, 242,
+		246,
+	}},
+	{hqRule{hqCrossNone, hq11, hq11}, []uint8{
+		3, 7, 35, 39, 67, 71, 83, 87, 99, 103, 115, 131, 135, 147, 151, 163,
+		167, 179, 183, 195, 199, 211, 215, 227, 231, 243, 247,
+	}},
+	{hqRule{hqCrossNone, hq21, hq21}, []uint8{
+		8, 12, 24, 28, 40, 44, 56, 60, 72, 76, 88, 92, 104, 108, 120, 124,
+		136, 140, 152, 156, 168, 172, 184, 188, 200, 204, 216, 220, 232, 236,
+		248, 252,
+	}},
+	{hqRule{hqCrossNone, hq12, hq12}, []uint8{
+		9, 13, 25, 29, 41, 45, 57, 61, 89, 93, 121, 137, 141, 153, 157, 169,
+		173, 185, 189, 201, 205, 217, 221, 233, 237, 249, 253,
+	}},
+	{hqRule{hqCrossXY, hq10, hq20}, []uint8{
+		10, 138,
+	}},
+	{hqRule{hqCrossXY, hqE, hq20}, []uint8{
+		11, 26, 27, 31, 59, 74, 75, 79, 91, 95, 107, 123, 139, 155, 159, 203,
+		219, 223, 235, 251,
+	}},
+	{hqRule{hqCrossXY, hq10, hq90}, []uint8{
+		14, 42, 142, 170,
+	}},
+	{hqRule{hqCrossXY, hqE, hq90}, []uint8{
+		15, 43, 143, 171, 187, 207,
+	}},
+	{hqRule{hqCrossYNext, hq11, hq60}, []uint8{
+		19, 23, 51, 55, 119,
+	}},
+	{hqRule{hqCrossNone, hq10, hq10}, []uint8{
+		30, 62, 106, 110, 126, 190, 222, 238, 250, 254,
+	}},
+	{hqRule{hqCrossXY, hq10, hq70}, []uint8{
+		46, 58, 78, 90, 94, 122, 154, 158, 174, 186, 202, 206, 218, 234,
+	}},
+	{hqRule{hqCrossXY, hqE, hq100}, []uint8{
+		47, 63, 111, 127, 175, 191, 239, 255,
+	}},
+	{hqRule{hqCrossXPrev, hq12, hq61}, []uint8{
+		73, 77, 105, 109, 125,
+	}},
+}
+
+// hq3xCorners and hq3xEdges give the rules of the top left and top
+// middle output pixels of hq3x.
+var hq3xCorners = []hqCase{
+	{hqRule{hqCrossNone, hq20, hq20}, []uint8{
+		0, 1, 4, 5, 16, 17, 20, 21, 32, 33, 36, 37, 48, 49, 52, 53, 64, 65,
+		68, 69, 80, 81, 84, 85, 96, 97, 100, 101, 112, 113, 116, 117, 128,
+		129, 132, 133, 144, 145, 148, 149, 160, 161, 164, 165, 176, 177, 180,
+		181, 192, 193, 196, 197, 208, 209, 212, 213, 224, 225, 228, 229, 240,
+		241, 244, 245,
+	}},
+	{hqRule{hqCrossNone, hq10, hq10}, []uint8{
+		2, 6, 8, 12, 18, 22, 24, 28, 30, 34, 38, 40, 44, 50, 54, 56, 60, 62,
+		66, 70, 72, 76, 82, 86, 88, 92, 98, 102, 104, 106, 108, 110, 114, 118,
+		120, 124, 126, 130, 134, 136, 140, 146, 150, 152, 156, 162, 166, 168,
+		172, 178, 182, 184, 188, 190, 194, 198, 200, 204, 210, 214, 216, 220,
+		222, 226, 230, 232, 236, 238, 242, 246, 248, 250, 252, 254,
+	}},
+	{hqRule{hqCrossNone, hq11, hq11}, []uint8{
+		3, 7, 35, 39, 67, 71, 83, 87, 99, 103, 115, 131, 135, 147, 151, 163,
+		167, 179, 183, 195, 199, 211, 215, 227, 231, 243, 247,
+	}},
+	{hqRule{hqCrossNone, hq12, hq12}, []uint8{
+		9, 13, 25, 29, 41, 45, 57, 61, 89, 93, 121, 137, 141, 153, 157, 169,
+		173, 185, 189, 201, 205, 217, 221, 233, 237, 249, 253,
+	}},
+	{hqRule{hqCrossXY, hq10, hq4}, []uint8{
+		10, 138,
+	}},
+	{hqRule{hqCrossXY, hqE, hq4}, []uint8{
+		11, 26, 27, 31, 59, 74, 75, 79, 91, 95, 107, 123, 139, 155, 159, 203,
+		219, 223, 235, 251,
+	}},
+	{hqRule{hqCrossXY, hq10, hq5}, []uint8{
+		14, 42, 142, 170,
+	}},
+	{hqRule{hqCrossXY, hqE, hq5}, []uint8{
+		15, 43, 143, 171, 187, 207,
+	}},
+	{hqRule{hqCrossYNext, hq11, hq20}, []uint8{
+		19, 23, 51, 55, 119,
+	}},
+	{hqRule{hqCrossXY, hq10, hq20}, []uint8{
+		46, 58, 78, 90, 94, 122, 154, 158, 174, 186, 202, 206, 218, 234,
+	}},
+	{hqRule{hqCrossXY, hqE, hq20}, []uint8{
+		47, 63, 111, 127, 175, 191, 239, 255,
+	}},
+	{hqRule{hqCrossXPrev, hq12, hq20}, []uint8{
+		73, 77, 105, 109, 125,
+	}},
+}
+
+var hq3xEdges = []hqCase{
+	{hqRule{hqCrossNone, hq12, hq12}, []uint8{
+		0, 1, 4, 5, 8, 9, 12, 13, 16, 17, 20, 21, 24, 25, 28, 29, 32, 33, 36,
+		37, 40, 41, 44, 45, 48, 49, 52, 53, 56, 57, 60, 61, 64, 65, 68, 69,
+		72, 73, 76, 77, 80, 81, 84, 85, 88, 89, 92, 93, 96, 97, 100, 101, 104,
+		105, 108, 109, 112, 113, 116, 117, 120, 121, 124, 125, 128, 129, 132,
+		133, 136, 137, 140, 141, 144, 145, 148, 149, 152, 153, 156, 157, 160,
+		161, 164, 165, 168, 169, 172, 173, 176, 177, 180, 181, 184, 185, 188,
+		189, 192, 193, 196, 197, 200, 201, 204, 205, 208, 209, 212, 213, 216,
+		217, 220, 221, 224, 225, 228, 229, 232, 233, 236, 237, 240, 241, 244,
+		245, 248, 249, 252, 253,
+	}},
+	{hqRule{hqCrossNone, hqE, hqE}, []uint8{
+		2, 3, 6, 7, 26, 31, 34, 35, 38, 39, 46, 47, 58, 66, 67, 70, 71, 78,
+		83, 90, 95, 98, 99, 102, 103, 106, 110, 111, 114, 115, 122, 130, 131,
+		134, 135, 147, 151, 154, 162, 163, 166, 167, 174, 175, 179, 183, 186,
+		191, 194, 195, 198, 199, 202, 206, 210, 211, 215, 218, 226, 227, 230,
+		231, 234, 238, 239, 242, 243, 247, 250, 255,
+	}},
+	{hqRule{hqCrossXY, hqE, hqEdge3}, []uint8{
+		10, 11, 27, 59, 74, 75, 79, 91, 107, 123, 138, 139, 155, 159, 203,
+		219, 223, 235, 251,
+	}},
+	{hqRule{hqCrossXY, hqE, hqEdge6}, []uint8{
+		14, 15, 142, 143, 207,
+	}},
+	{hqRule{hqCrossYNext, hqE, hqEdge3}, []uint8{
+		18, 22, 30, 50, 54, 62, 63, 82, 86, 87, 94, 118, 126, 127, 158, 214,
+		222, 246, 254,
+	}},
+	{hqRule{hqCrossYNext, hqE, hqEdge6}, []uint8{
+		19, 23, 51, 55, 119,
+	}},
+	{hqRule{hqCrossXY, hqE, hq12}, []uint8{
+		42, 43, 170, 171, 187,
+	}},
+	{hqRule{hqCrossYNext, hqE, hq12}, []uint8{
+		146, 150, 178, 182, 190,
+	}},
+}
+
+var hq2xTable, hq3xCornerTable, hq3xEdgeTable [256]hqRule
+
+// hqTurns maps the neighbourhood as seen from each corner, clockwise from
+// the top left, to the one of the picture.
+var hqTurns [4][9]int
+
+func hqTable(t *[256]hqRule, cases []hqCase) {
+	for _, c := range cases {
+		for _, p := range c.patterns {
+			t[p] = c.rule
+		}
+	}
+}
+
+func init() {
+	hqTable(&hq2xTable, hq2xCorners)
+	hqTable(&hq3xCornerTable, hq3xCorners)
+	hqTable(&hq3xEdgeTable, hq3xEdges)
+	for t := range hqTurns {
+		for i := range hqTurns[t] {
+			x, y := i%3-1, i/3-1
+			for n := 0; n < t; n++ {
+				x, y = -y, x
+			}
+			hqTurns[t][i] = (y+1)*3 + x + 1
+		}
+	}
+}
+
+// Output pixels of the corners and of the edges after them, clockwise from
+// the top left
+var (
+	hq2xCornerPos = [4][2]int{{0, 0}, {1, 0}, {1, 1}, {0, 1}}
+	hq3xCornerPos = [4][2]int{{0, 0}, {2, 0}, {2, 2}, {0, 2}}
+	hq3xEdgePos   = [4][2]int{{1, 0}, {2, 1}, {1, 2}, {0, 1}}
+)
+
+// HqxFilter is the hq2x/hq3x scaler.
+type HqxFilter struct {
+	Factor int
+	src    rgbaPixels
+	dst    *image.RGBA
+}
+
+func NewHqxFilter(factor int) *HqxFilter {
+	return &HqxFilter{Factor: factor}
+}
+
+func (f *HqxFilter) Apply(src *image.RGBA) *image.RGBA {
+	p := &f.src
+	p.load(src)
+	n := f.Factor
+	f.dst = reuseRGBA(f.dst, p.w*n, p.h*n)
+	var w, turned [9]uint32
+	var differs [9]bool
+	for y := 0; y < p.h; y++ {
+		for x := 0; x < p.w; x++ {
+			for i := range w {
+				w[i] = p.at(x+i%3-1, y+i/3-1)
+			}
+			for i := range w {
+				differs[i] = yuvDiffers(w[4], w[i])
+			}
+			for t := range hqTurns {
+				pattern, bit := 0, 0
+				for i, j := range hqTurns[t] {
+					turned[i] = w[j]
+					if i == 4 {
+						continue
+					}
+					if differs[j] {
+						pattern |= 1 << bit
+					}
+					bit++
+				}
+				if n == 2 {
+					pos := hq2xCornerPos[t]
+					setPixel(f.dst, x*2+pos[0], y*2+pos[1], hq2xTable[pattern].apply(&turned))
+				} else {
+					pos := hq3xCornerPos[t]
+					setPixel(f.dst, x*3+pos[0], y*3+pos[1], hq3xCornerTable[pattern].apply(&turned))
+					pos = hq3xEdgePos[t]
+					setPixel(f.dst, x*3+pos[0], y*3+pos[1], hq3xEdgeTable[pattern].apply(&turned))
+				}
+			}
+			if n == 3 {
+				setPixel(f.dst, x*3+1, y*3+1, w[4])
+			}
+		}
+	}
+	return f.dst
+}
+
+//
+// xBR
+//
+
+// XbrFilter is the 2xBR scaler, xBR level 2 at twice the size. Each
+// corner of a pixel looks for an edge running diagonally through it by
+// weighing the color distances along both diagonals. The corner is then
+// blended towards the other side of the edge, and for shallow and steep
+// edges the output pixel next to it along the edge is blended too.
+type XbrFilter struct {
+	src rgbaPixels
+	dst *image.RGBA
+}
+
+func NewXbrFilter() *XbrFilter {
+	return new(XbrFilter)
+}
+
+func yuvDist(c1 uint32, c2 uint32) int {
+	y1, u1, v1 := rgbToYuv(c1)
+	y2, u2, v2 := rgbToYuv(c2)
+	return 48*absInt(y1-y2) + 7*absInt(u1-u2) + 6*absInt(v1-v2)
+}
+
+const xbrEqThreshold = 155
+
+func xbrEq(c1 uint32, c2 uint32) bool {
+	return yuvDist(c1, c2) < xbrEqThreshold
+}
+
+// xbrTurn turns the neighbourhood so that the corner worked on is the
+// bottom right one: right and down are the directions of x and y, and n1,
+// n2 and n3 the output pixels above the corner, left of it and at it.
+type xbrTurn struct {
+	right, down [2]int
+	n1, n2, n3  int
+}
+
+var xbrTurns = [4]xbrTurn{
+	{[2]int{1, 0}, [2]int{0, 1}, 1, 2, 3},
+	{[2]int{0, -1}, [2]int{1, 0}, 0, 3, 1},
+	{[2]int{-1, 0}, [2]int{0, -1}, 2, 1, 0},
+	{[2]int{0, 1}, [2]int{-1, 0}, 3, 0, 2},
+}
+
+// xbrBlend moves c eighths of the way towards to.
+func xbrBlend(c uint32, to uint32, eighths uint32) uint32 {
+	return blend2(c, 8-eighths, to, eighths)
+}
+
+// xbrCorner works on the bottom right corner of e with the rest of the
+// 5x5 neighbourhood named as
+//
+//	   a1 b1 c1
+//	a0 a  b  c  c4
+//	d0 d  e  f  f4
+//	g0 g  h  i  i4
+//	   g5 h5 i5
+func xbrCorner(out *[4]uint32, t *xbrTurn, at func(dx, dy int) uint32) {
+	e, f, h := at(0, 0), at(1, 0), at(0, 1)
+	if e == f || e == h {
+		return
+	}
+	i, b, c, d, g := at(1, 1), at(0, -1), at(1, -1), at(-1, 0), at(-1, 1)
+	f4, i4, h5, i5 := at(2, 0), at(2, 1), at(0, 2), at(1, 2)
+	wd1 := yuvDist(e, c) + yuvDist(e, g) + yuvDist(i, h5) + yuvDist(i, f4) + 4*yuvDist(h, f)
+	wd2 := yuvDist(h, d) + yuvDist(h, i5) + yuvDist(f, i4) + yuvDist(f, b) + 4*yuvDist(e, i)
+	px := h
+	if yuvDist(e, f) <= yuvDist(e, h) {
+		px = f
+	}
+	edge := !xbrEq(f, b) && !xbrEq(h, d) ||
+		xbrEq(e, i) && !xbrEq(f, i4) && !xbrEq(h, i5) ||
+		xbrEq(e, g) || xbrEq(e, c)
+	if wd1 < wd2 && edge {
+		ke := yuvDist(f, g)
+		ki := yuvDist(h, c)
+		shallow := 2*ke <= ki && e != g && d != g
+		steep := ke >= 2*ki && e != c && b != c
+		switch {
+		case shallow && steep:
+			out[t.n3] = xbrBlend(out[t.n3], px, 7)
+			out[t.n2] = xbrBlend(out[t.n2], px, 2)
+			out[t.n1] = out[t.n2]
+		case shallow:
+			out[t.n3] = xbrBlend(out[t.n3], px, 6)
+			out[t.n2] = xbrBlend(out[t.n2], px, 2)
+		case steep:
+			out[t.n3] = xbrBlend(out[t.n3], px, 6)
+			out[t.n1] = xbrBlend(out[t.n1], px, 2)
+		default:
+			out[t.n3] = xbrBlend(out[t.n3], px, 4)
+		}
+	} else if wd1 <= wd2 {
+		out[t.n3] = xbrBlend(out[t.n3], px, 4)
+	}
+}
+
+func (f *XbrFilter) Apply(src *image.RGBA) *image.RGBA {
+	p := &f.src
+	p.load(src)
+	f.dst = reuseRGBA(f.dst, p.w*2, p.h*2)
+	for y := 0; y < p.h; y++ {
+		for x := 0; x < p.w; x++ {
+			e := p.at(x, y)
+			out := [4]uint32{e, e, e, e}
+			for k := range xbrTurns {
+				t := &xbrTurns[k]
+				xbrCorner(&out, t, func(dx, dy int) uint32 {
+					return p.at(x+dx*t.right[0]+dy*t.down[0], y+dx*t.right[1]+dy*t.down[1])
+				})
+			}
+			setPixel(f.dst, x*2, y*2, out[0])
+			setPixel(f.dst, x*2+1, y*2, out[1])
+			setPixel(f.dst, x*2, y*2+1, out[2])
+			setPixel(f.dst, x*2+1, y*2+1, out[3])
+		}
+	}
+	return f.dst
+}
+
+//
+// Filter names for configuration
+//
+
+// ParseFilters reads a comma separated list of filters such as
+// "crop,hq2x,scanlines". Crop takes an optional number of lines,
+// "crop:8", and scanlines a strength in percent, "scanlines:30".
+func ParseFilters(spec string) ([]ImageFilter, error) {
+	var filters []ImageFilter
+	if spec == "" {
+		return filters, nil
+	}
+	for _, s := range strings.Split(spec, ",") {
+		name, arg, hasArg := strings.Cut(strings.TrimSpace(s), ":")
+		n := 0
+		if hasArg {
+			var err error
+			if n, err = strconv.Atoi(arg); err != nil || n < 0 {
+				return nil, fmt.Errorf("filter %s: invalid argument %s", name, arg)
+			}
+		}
+		var f ImageFilter
+		switch strings.ToLower(name) {
+		case "crop":
+			if !hasArg {
+				n = 8
+			}
+			f = NewCropFilter(n, n, 0, 0)
+		case "scanlines":
+			if !hasArg {
+				n = 25
+			}
+			if n > 100 {
+				return nil, errors.New("filter scanlines: strength is a percentage")
+			}
+			f = NewScanlineFilter(float64(n) / 100)
+		case "scale2x":
+			f = NewScaleNxFilter(2)
+		case "scale3x":
+			f = NewScaleNxFilter(3)
+		case "hq2x":
+			f = NewHqxFilter(2)
+		case "hq3x":
+			f = NewHqxFilter(3)
+		case "xbr":
+			f = NewXbrFilter()
+		default:
+			return nil, fmt.Errorf("unknown filter: %s", name)
+		}
+		filters = append(filters, f)
+	}
+	return filters, nil
+}
+
+func newConfFilterChain(conf *Conf, pal *Palette) *FilterChain {
+	var source FrameFilter
+	if conf.NtscFilter != "" {
+		if setup, err := NtscPresetByName(conf.NtscFilter); err == nil {
+			source = NewNtscFilter(setup)
+		} else {
+			fmt.Println(err)
+		}
+	}
+	filters, err := ParseFilters(conf.Filters)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return NewFilterChain(pal, source, filters...)
+}
@@ -0,0 +1,43 @@
+package nespkg
+
+// AxROM: 32KB PRG banks and single-screen mirroring selected by the same
+// register, CHR RAM.
+type Mapper007 struct {
+	MapperBase
+}
+
+func (mapper *Mapper007) Init() {
+	Debug("Mapper007 Init()\n")
+	mapper.selectBank(0)
+}
+
+func (mapper *Mapper007) regWrite8(address uint16, val uint8) {
+	if address >= 0x8000 && address <= 0xffff {
+		mapper.selectBank(val)
+	}
+}
+
+func (mapper *Mapper007) selectBank(val uint8) {
+	banks := len(mapper.nes.rom.prgRom) / 0x8000
+	if banks == 0 {
+		// A 16KB PRG ROM is mirrored like NROM.
+		mapper.mapPrgRom(0x8000, 0, 0x4000)
+		mapper.mapPrgRom(0xC000, 0, 0x4000)
+	} else {
+		bank := int(val&0x07) % banks
+		Debug("Mapper007 bank=%d\n", bank)
+		mapper.mapPrgRom(0x8000, 0x8000*bank, 0x8000)
+	}
+	if val&0x10 != 0 {
+		mapper.setMirroring(MirrorSingleB)
+	} else {
+		mapper.setMirroring(MirrorSingleA)
+	}
+}
+
+func NewMapper007(nes *Nes) Mapper {
+	mapper := new(Mapper007)
+	mapper.mapperNum = 7
+	mapper.nes = nes
+	return mapper
+}
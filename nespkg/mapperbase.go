@@ -1,8 +1,10 @@
 package nespkg
 
 type MapperBase struct {
-	nes       *Nes
-	mapperNum int
+	nes           *Nes
+	mapperNum     int
+	prgPageOffset [mmMemorySpaceSize / mmPageSize]int
+	chrPageOffset [0x2000 / vramPageSize]int
 }
 
 func (mapper *MapperBase) regWrite8(address uint16, val uint8) {
@@ -16,15 +18,56 @@ func (mapper *MapperBase) regWrite8(address uint16, val uint8) {
 	return
 }
 
+// mapPrgRom maps PRG ROM bytes from offset to the CPU address and remembers
+// the offset of each page, so that CPU addresses can be turned back into
+// ROM offsets.
+func (mapper *MapperBase) mapPrgRom(address uint16, offset int, bytes int) {
+	nes := mapper.nes
+	nes.mem.mapExtMem(address, nes.rom.prgRom[offset:offset+bytes], bytes)
+	for i := 0; i < bytes; i += mmPageSize {
+		mapper.prgPageOffset[page(address+uint16(i))] = offset + i
+	}
+}
+
+func (mapper *MapperBase) mapChrRom(address uint16, offset int, bytes int) {
+	nes := mapper.nes
+	nes.ppu.mapExtMem(address, nes.rom.chrRom[offset:offset+bytes], bytes)
+	for i := 0; i < bytes; i += vramPageSize {
+		mapper.chrPageOffset[vramPage(address+uint16(i))] = offset + i
+	}
+}
+
+func (mapper *MapperBase) setMirroring(m Mirroring) {
+	mapper.nes.ppu.SetMirroring(m)
+}
+
+// prgRomOffset returns the PRG ROM offset mapped at the CPU address, or -1
+// if no ROM is mapped there.
+func (mapper *MapperBase) prgRomOffset(address uint16) int {
+	if address < 0x8000 || len(mapper.nes.rom.prgRom) == 0 {
+		return -1
+	}
+	return mapper.prgPageOffset[page(address)] + int(offset(address))
+}
+
+// chrRomOffset returns the CHR ROM offset mapped at the PPU address, or -1
+// if it is not a pattern table address or the cartridge has CHR RAM.
+func (mapper *MapperBase) chrRomOffset(address uint16) int {
+	if address >= 0x2000 || len(mapper.nes.rom.chrRom) == 0 {
+		return -1
+	}
+	return mapper.chrPageOffset[vramPage(address)] + int(address&(vramPageSize-1))
+}
+
 func (mapper *MapperBase) Init() {
 	Debug("MapperBase Init()\n")
 	nes := mapper.nes
-	nes.mem.mapExtMem(0x8000, nes.rom.prgRom, len(nes.rom.prgRom))
+	mapper.mapPrgRom(0x8000, 0, len(nes.rom.prgRom))
 	if nes.rom.prgRomSizeIn16KB == 1 {
-		nes.mem.setNrom128Mirror()
+		mapper.mapPrgRom(0xC000, 0, 0x4000)
 	}
 
-	nes.ppu.mapExtMem(0, nes.rom.chrRom, len(nes.rom.chrRom))
+	mapper.mapChrRom(0, 0, len(nes.rom.chrRom))
 }
 
 func NewMapperBase(nes *Nes) Mapper {
@@ -7,6 +7,8 @@ import (
 type Mapper interface {
 	Init()
 	regWrite8(address uint16, val uint8)
+	prgRomOffset(address uint16) int
+	chrRomOffset(address uint16) int
 }
 
 type MapperMaker func(*Nes) Mapper
@@ -14,6 +16,7 @@ type MapperMaker func(*Nes) Mapper
 var mapperTable = map[int]MapperMaker{
 	0: NewMapperBase,
 	3: NewMapper003,
+	7: NewMapper007,
 }
 
 func MakeMapper(nes *Nes, mapperNum int) (Mapper, error) {
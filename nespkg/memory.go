@@ -6,8 +6,10 @@ const mmPageSize = 1 << mmPageShift
 const mmMemorySpaceSize = 0x10000
 
 type MainMemory struct {
-	mem [mmMemorySpaceSize / mmPageSize][]uint8
-	nes *Nes
+	InterruptLines
+	mem    [mmMemorySpaceSize / mmPageSize][]uint8
+	nes    *Nes
+	synced uint
 }
 
 func isPpuRegAddress(address uint16) bool {
@@ -33,7 +35,7 @@ func isGamepadAddress1(address uint16) bool {
 }
 
 func isApuRegAddress(address uint16) bool {
-	if address >= 0x4000 && address <= 0x4003 {
+	if address >= 0x4000 && address <= 0x4013 || address == apuRegAddressStatus {
 		return true
 	}
 	return false
@@ -49,6 +51,9 @@ func offset(address uint16) uint {
 
 func (m *MainMemory) Read8(address uint16) uint8 {
 	v := m.Read8NoTrace(address)
+	if m.nes.cdl != nil && address >= 0x8000 {
+		m.nes.cdl.logData(address)
+	}
 	if MemTraceEnable {
 		Debug("  Rd8: %04X -> %02X\n", address, v)
 	}
@@ -56,7 +61,11 @@ func (m *MainMemory) Read8(address uint16) uint8 {
 }
 
 func (m *MainMemory) Read8NoTrace(address uint16) uint8 {
+	if address < 0x2000 || address >= 0x4020 {
+		return m.mem[page(address)][offset(address)]
+	}
 	if isPpuRegAddress(address) {
+		m.syncPpu()
 		return m.nes.ppu.readMmapReg(address)
 	} else if isGamepadAddress0(address) {
 		return m.nes.Pad[0].regRead()
@@ -68,6 +77,43 @@ func (m *MainMemory) Read8NoTrace(address uint16) uint8 {
 	return m.mem[page(address)][offset(address)]
 }
 
+// Peek8 reads memory without side effects. Register space is not read and
+// returns $FF, as Nintendulator shows it in trace logs.
+func (m *MainMemory) Peek8(address uint16) uint8 {
+	if address >= 0x2000 && address < 0x4020 {
+		return 0xff
+	}
+	return m.mem[page(address)][offset(address)]
+}
+
+func (m *MainMemory) Tick(cycle uint) {
+	m.nes.ppu.giveCpuClockDelta(cycle - m.synced)
+	m.synced = 0
+	m.nes.apu.tick(cycle)
+}
+
+// syncPpu brings the dot based PPU up to the cycle of the register access
+// in the current instruction, so that its effects happen on the right dot.
+func (m *MainMemory) syncPpu() {
+	if !m.nes.ppu.dotMode {
+		return
+	}
+	if c := m.nes.cpu.accessCycle(); c > m.synced {
+		m.nes.ppu.giveCpuClockDelta(c - m.synced)
+		m.synced = c
+	}
+}
+
+// Poke8 writes straight into the memory mapped at address, including
+// cartridge ROM, so the debugger can patch code.
+func (m *MainMemory) Poke8(address uint16, val uint8) {
+	if address >= 0x2000 && address < 0x4020 {
+		m.Write8NoTrace(address, val)
+		return
+	}
+	m.mem[page(address)][offset(address)] = val
+}
+
 func (m *MainMemory) isRam(address uint16) bool {
 	if address >= 0 && address < 0x2000 {
 		return true
@@ -86,10 +132,11 @@ func (m *MainMemory) Write8NoTrace(address uint16, val uint8) {
 	if m.isRam(address) {
 		m.mem[page(address)][offset(address)] = val
 	} else if isPpuRegAddress(address) {
+		m.syncPpu()
 		m.nes.ppu.writeMmapReg(address, val)
 	} else if isGamepadAddress0(address) {
 		m.nes.Pad[0].regWrite(val)
-	} else if isApuRegAddress(address) {
+	} else if isApuRegAddress(address) || address == apuRegAddressFrameCounter {
 		m.nes.apu.WriteReg(address, val)
 	} else if address >= 0x8000 && address <= 0xffff {
 		m.nes.mapper.regWrite8(address, val)
@@ -114,12 +161,6 @@ func (m *MainMemory) Write16NoTrace(address uint16, v uint16) {
 	m.Write8NoTrace(address+1, uint8(v>>8))
 }
 
-func (m *MainMemory) setNrom128Mirror() {
-	for a := 0xC000; a < 0x10000; a += mmPageSize {
-		m.mem[page(uint16(a))] = m.mem[page(uint16(a-0x4000))]
-	}
-}
-
 func NewMainMemory(nes *Nes) *MainMemory {
 	m := new(MainMemory)
 	m.mem[page(0x0000)] = make([]uint8, mmPageSize)
@@ -0,0 +1,88 @@
+package nespkg
+
+//
+// Nametable mirroring
+//
+// The console has 2KB of nametable RAM, CIRAM, for the four 1KB nametables
+// at $2000-$2FFF. How they share it is up to the cartridge, which can also
+// put its own memory there. $3000-$3EFF mirrors $2000-$2EFF.
+//
+
+type Mirroring int
+
+const (
+	MirrorHorizontal Mirroring = iota
+	MirrorVertical
+	MirrorSingleA
+	MirrorSingleB
+	MirrorFourScreen
+)
+
+const nametableSize = 0x400
+
+var mirroringNames = []string{"horizontal", "vertical", "single A", "single B", "four-screen"}
+
+func (m Mirroring) String() string {
+	if int(m) < len(mirroringNames) {
+		return mirroringNames[m]
+	}
+	return "unknown"
+}
+
+// CIRAM lives at $2000-$27FF of vram. The 2KB after it stands in for the
+// cartridge RAM of four-screen boards.
+func (ppu *Ppu) ciram(page int) []uint8 {
+	base := 0x2000 + page*nametableSize
+	return ppu.vram[base : base+nametableSize]
+}
+
+// SetMirroring lays the nametables out over CIRAM. It can be called at any
+// time, as mappers do when a register write changes the mirroring.
+func (ppu *Ppu) SetMirroring(m Mirroring) {
+	var pages [4]int
+	switch m {
+	case MirrorHorizontal:
+		pages = [4]int{0, 0, 1, 1}
+	case MirrorVertical:
+		pages = [4]int{0, 1, 0, 1}
+	case MirrorSingleA:
+		pages = [4]int{0, 0, 0, 0}
+	case MirrorSingleB:
+		pages = [4]int{1, 1, 1, 1}
+	case MirrorFourScreen:
+		pages = [4]int{0, 1, 2, 3}
+	}
+	for n, page := range pages {
+		ppu.SetNametable(n, ppu.ciram(page))
+	}
+	ppu.mirroring = m
+	Debug("mirroring=%s\n", m)
+}
+
+// SetNametable puts 1KB of mem at nametable n, 0-3. Mappers use it for
+// cartridge VRAM. Writes to the nametable go to mem, so it must not be a
+// slice of the ROM image.
+func (ppu *Ppu) SetNametable(n int, mem []uint8) {
+	base := uint16(0x2000 + n*nametableSize)
+	for i := uint16(0); i < nametableSize; i += vramPageSize {
+		page := mem[i : i+vramPageSize]
+		ppu.lvram[vramPage(base+i)] = page
+		if mirror := base + 0x1000 + i; mirror < 0x3f00 {
+			ppu.lvram[vramPage(mirror)] = page
+		}
+	}
+}
+
+func (ppu *Ppu) Mirroring() Mirroring {
+	return ppu.mirroring
+}
+
+func (rom *NesRom) mirroring() Mirroring {
+	switch {
+	case rom.fourScreenVram:
+		return MirrorFourScreen
+	case rom.verticalMirror:
+		return MirrorVertical
+	}
+	return MirrorHorizontal
+}
@@ -5,6 +5,8 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"image"
+	"io"
 	"os"
 	"strconv"
 	"strings"
@@ -55,26 +57,57 @@ func bits(v uint, pos uint, width uint) uint {
 }
 
 type Nes struct {
-	cpu     *Cpu
-	ppu     *Ppu
-	apu     *Apu
-	Pad     [2]Gamepad
-	Kbd     *KbdReader
-	mem     *MainMemory
-	rom     *NesRom
-	mapper  Mapper
-	display Display
-	dbg     *Debugger
+	cpu            *Cpu
+	ppu            *Ppu
+	apu            *Apu
+	Pad            [2]Gamepad
+	Kbd            *KbdReader
+	mem            *MainMemory
+	rom            *NesRom
+	mapper         Mapper
+	display        Display
+	dbg            *Debugger
+	cdl            *CodeDataLogger
+	cdlFile        string
+	profiler       *Profiler
+	profileFrames  int
+	entryPoint     uint16
+	region         *Region
+	regionOverride bool
+	palette        *Palette
+	filter         FrameFilter
 }
 
 type Display interface {
-	Render(screen *[ScreenSizePixY][ScreenSizePixX]uint8)
+	Render(screen *[ScreenSizePixY][ScreenSizePixX]uint16)
+}
+
+// A FrameFilter turns the screen into an image on its way to an
+// ImageDisplay.
+type FrameFilter interface {
+	Filter(screen *[ScreenSizePixY][ScreenSizePixX]uint16, frame uint64) *image.RGBA
+}
+
+type ImageDisplay interface {
+	Display
+	RenderImage(im *image.RGBA)
 }
 
 type Conf struct {
 	DebugEnable    bool
 	TraceEnable    bool
 	MemTraceEnable bool
+	TraceLogFile   string
+	TraceRefFile   string
+	EntryPoint     uint
+	CdlFile        string
+	ProfileFrames  int
+	DotPpu         bool
+	NoSpriteLimit  bool
+	Region         string
+	Palette        string
+	NtscFilter     string
+	Filters        string
 }
 
 var DebugEnable bool = false
@@ -88,23 +121,98 @@ func Debug(f string, a ...interface{}) {
 
 func (nes *Nes) Reset() {
 	nes.cpu.Reset()
+	if nes.entryPoint != 0 {
+		nes.cpu.SetPC(nes.entryPoint)
+	}
+	if nes.profileFrames > 0 {
+		nes.EnableProfiler()
+	}
 }
 
 func (nes *Nes) Regdump() {
 	nes.cpu.Regdump()
 }
 
+// SetSpriteLimit turns the 8 sprites per line limit on or off. Without it
+// games that multiplex sprites no longer flicker.
+func (nes *Nes) SetSpriteLimit(on bool) {
+	nes.ppu.noSpriteLimit = !on
+}
+
+// SetFrameFilter puts f between the PPU and the display. It only takes
+// effect with an ImageDisplay, nil removes it.
+func (nes *Nes) SetFrameFilter(f FrameFilter) {
+	nes.filter = f
+}
+
+func (nes *Nes) renderFrame(screen *[ScreenSizePixY][ScreenSizePixX]uint16) {
+	nes.ppu.drawOverlays(screen)
+	if nes.filter != nil {
+		if d, ok := nes.display.(ImageDisplay); ok {
+			d.RenderImage(nes.filter.Filter(screen, nes.ppu.frame))
+			return
+		}
+	}
+	nes.display.Render(screen)
+}
+
+func (nes *Nes) Region() *Region {
+	return nes.region
+}
+
+func (nes *Nes) AssertIrq(src IrqSource) {
+	nes.mem.AssertIrq(src)
+}
+
+func (nes *Nes) ReleaseIrq(src IrqSource) {
+	nes.mem.ReleaseIrq(src)
+}
+
+func (nes *Nes) instHook(cpu *Cpu) {
+	nes.dbg.traceInst(cpu)
+	if nes.cdl != nil {
+		nes.cdl.logInst(cpu)
+	}
+}
+
+func (nes *Nes) intrHook(cpu *Cpu, vector uint16) {
+	if nes.cdl != nil {
+		nes.cdl.logInterrupt()
+	}
+}
+
 func NewNes(conf *Conf, d Display) *Nes {
 	DebugEnable = conf.DebugEnable
 	MemTraceEnable = conf.MemTraceEnable
 	nes := new(Nes)
-	nes.cpu = NewCpu(nes)
+	nes.region = RegionNtsc
+	if conf.Region != "" {
+		if r, err := RegionByName(conf.Region); err == nil {
+			nes.region = r
+			nes.regionOverride = true
+		} else {
+			fmt.Println(err)
+		}
+	}
+	var err error
+	if nes.palette, err = NewPalette(conf.Palette); err != nil {
+		fmt.Println(err)
+		nes.palette = NewDefaultPalette()
+	}
+	if conf.NtscFilter != "" || conf.Filters != "" {
+		nes.filter = newConfFilterChain(conf, nes.palette)
+	}
+	nes.mem = NewMainMemory(nes)
+	nes.cpu = NewCpu(nes.mem)
 	nes.ppu = NewPpu(nes)
+	nes.ppu.dotMode = conf.DotPpu
+	nes.ppu.noSpriteLimit = conf.NoSpriteLimit
 	nes.apu = NewApu(nes)
-	nes.mem = NewMainMemory(nes)
 	nes.Kbd = NewKbdReader()
-	nes.cpu.mem = nes.mem
 	nes.display = d
+	nes.entryPoint = uint16(conf.EntryPoint)
+	nes.cdlFile = conf.CdlFile
+	nes.profileFrames = conf.ProfileFrames
 	pad0 := NewUsbGamepad(0)
 	if pad0 == nil {
 		Debug("Installing Kbd gamepad\n")
@@ -114,6 +222,8 @@ func NewNes(conf *Conf, d Display) *Nes {
 	}
 	nes.Pad[1] = NewDummyGamepad()
 	nes.dbg = NewDebugger(conf, nes)
+	nes.cpu.SetTraceHook(nes.instHook)
+	nes.cpu.SetInterruptHook(nes.intrHook)
 	Debug("NewNes: nes=%p\n", nes)
 	return nes
 }
@@ -158,7 +268,13 @@ func NewNesRom(filename string, romImage []uint8) (*NesRom, error) {
 	rom.vsUnisystem = romImage[7]&0x01 != 0
 	rom.playChoice10 = romImage[7]&0x02 != 0
 	rom.nes2format = (romImage[7]&0x0c)>>2 == 2
-	rom.tvSystem = uint(romImage[9] & 0x03)
+	if rom.nes2format {
+		// 0: NTSC, 1: PAL, 2: multiple, 3: Dendy
+		rom.tvSystem = uint(romImage[12] & 0x03)
+	} else if bytes.Equal(romImage[12:16], []uint8{0, 0, 0, 0}) {
+		// Bytes 7-15 of old headers often hold garbage such as "DiskDude!"
+		rom.tvSystem = uint(romImage[9] & 0x01)
+	}
 
 	prgstart := uint(16)
 	if rom.trainerPresent {
@@ -210,14 +326,27 @@ func (nes *Nes) LoadRom(filename string) error {
 	Debug("ROM header analyzed\n")
 	rom.PrintRomData()
 	nes.rom = rom
+	if !nes.regionOverride {
+		nes.region = rom.region()
+	}
+	Debug("region=%s\n", nes.region.Name)
 	var err3 error
 	nes.mapper, err3 = MakeMapper(nes, rom.mapperNum)
 	if err3 != nil {
 		return err3
 	}
-	nes.mapper.Init()
 	Debug("calling PostRomLoadSetup\n")
 	nes.ppu.PostRomLoadSetup()
+	nes.ppu.watchMapper(nes.mapper)
+	nes.mapper.Init()
+	if nes.cdlFile != "" {
+		nes.EnableCdl()
+		if _, err := os.Stat(nes.cdlFile); err == nil {
+			if err := nes.cdl.Load(nes.cdlFile); err != nil {
+				return err
+			}
+		}
+	}
 	Debug("returning from LoadRom\n")
 	return nil
 }
@@ -226,34 +355,58 @@ func (nes *Nes) Stop() {
 	nes.dbg.step = true
 }
 
-const framePeriodMicroSeconds = time.Microsecond * 16666
+// Close flushes the trace log and closes the trace files. Call it once the
+// emulation is over.
+func (nes *Nes) Close() {
+	nes.dbg.closeTrace()
+}
 
 func (nes *Nes) Run() {
 	nes.Reset()
 	lastRefreshTime := time.Now()
-	apuFrame := 0
+	frame := nes.ppu.frame
 	for {
-		cycle := nes.cpu.executeInst()
-		if nes.ppu.giveCpuClockDelta(cycle) {
-			if apuFrame%6 == 0 {
-				nes.apu.giveFrameTiming()
+		nes.cpu.executeInst()
+		if nes.ppu.frame != frame {
+			frame = nes.ppu.frame
+			if nes.dbg.traceLog != nil {
+				nes.dbg.traceLog.Flush()
 			}
+			nes.profileFrame()
+			nes.apu.giveFrameTiming()
 			t := time.Since(lastRefreshTime)
-			time.Sleep(framePeriodMicroSeconds - t)
+			time.Sleep(nes.region.framePeriod() - t)
 			lastRefreshTime = time.Now()
 		}
-		apuFrame++
 		nes.dbg.hook()
 	}
 }
 
+// RunFrames runs the emulation unthrottled for the given number of frames,
+// without sound, frame pacing or the debugger, and returns the number of
+// instructions executed.
+func (nes *Nes) RunFrames(frames int) uint64 {
+	var insts uint64
+	last := nes.ppu.frame + uint64(frames)
+	for nes.ppu.frame < last {
+		nes.cpu.executeInst()
+		insts++
+	}
+	return insts
+}
+
 type Debugger struct {
-	nes     *Nes
-	ibp     [8]uint16
-	step    bool
-	trace   bool
-	scanner *bufio.Scanner
-	prevCmd DbgCmd
+	nes       *Nes
+	ibp       [8]uint16
+	step      bool
+	trace     bool
+	scanner   *bufio.Scanner
+	prevCmd   DbgCmd
+	traceLog  *bufio.Writer
+	traceRef  *bufio.Scanner
+	traceLine int
+	// the trace files, closed by Close
+	traceFiles []*os.File
 }
 
 func NewDebugger(conf *Conf, nes *Nes) *Debugger {
@@ -266,6 +419,27 @@ func NewDebugger(conf *Conf, nes *Nes) *Debugger {
 		dbg.ibp[i] = 0
 	}
 	dbg.scanner = bufio.NewScanner(os.Stdin)
+	if conf.TraceLogFile != "" {
+		f, err := os.Create(conf.TraceLogFile)
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			dbg.traceLog = bufio.NewWriter(f)
+			dbg.traceFiles = append(dbg.traceFiles, f)
+		}
+	}
+	if conf.TraceRefFile != "" {
+		f, err := os.Open(conf.TraceRefFile)
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			dbg.traceRef = bufio.NewScanner(f)
+			dbg.traceFiles = append(dbg.traceFiles, f)
+			if dbg.traceLog == nil {
+				dbg.traceLog = bufio.NewWriter(io.Discard)
+			}
+		}
+	}
 	return dbg
 }
 
@@ -293,17 +467,22 @@ type DbgCmd interface {
 }
 
 var DbgCmdTable = map[string]DbgCmdTableEntry{
-	"a":   {NewDbgCmdAsm},
-	"s":   {func(args []string) (DbgCmd, error) { return new(DbgCmdStep), nil }},
-	"c":   {func(args []string) (DbgCmd, error) { return new(DbgCmdCont), nil }},
-	"t":   {func(args []string) (DbgCmd, error) { return new(DbgCmdTrace), nil }},
-	"mt":  {func(args []string) (DbgCmd, error) { return new(DbgCmdMemoryTrace), nil }},
-	"p":   {func(args []string) (DbgCmd, error) { return new(DbgCmdPpureg), nil }},
-	"m":   {NewDbgCmdMem},
-	"v":   {NewDbgCmdVramRead},
-	"r":   {func(args []string) (DbgCmd, error) { return new(DbgCmdRep), nil }},
-	"":    {func(args []string) (DbgCmd, error) { return new(DbgCmdRep), nil }},
-	"nop": {func(args []string) (DbgCmd, error) { return new(DbgCmdNop), nil }},
+	"a":    {NewDbgCmdAsm},
+	"asm":  {NewDbgCmdAssemble},
+	"cdl":  {NewDbgCmdCdl},
+	"prof": {NewDbgCmdProfile},
+	"pv":   {NewDbgCmdPpuView},
+	"view": {NewDbgCmdDebugView},
+	"s":    {func(args []string) (DbgCmd, error) { return new(DbgCmdStep), nil }},
+	"c":    {func(args []string) (DbgCmd, error) { return new(DbgCmdCont), nil }},
+	"t":    {func(args []string) (DbgCmd, error) { return new(DbgCmdTrace), nil }},
+	"mt":   {func(args []string) (DbgCmd, error) { return new(DbgCmdMemoryTrace), nil }},
+	"p":    {func(args []string) (DbgCmd, error) { return new(DbgCmdPpureg), nil }},
+	"m":    {NewDbgCmdMem},
+	"v":    {NewDbgCmdVramRead},
+	"r":    {func(args []string) (DbgCmd, error) { return new(DbgCmdRep), nil }},
+	"":     {func(args []string) (DbgCmd, error) { return new(DbgCmdRep), nil }},
+	"nop":  {func(args []string) (DbgCmd, error) { return new(DbgCmdNop), nil }},
 }
 
 type DbgCmdBase struct {
@@ -332,13 +511,12 @@ func (cmd *DbgCmdPpureg) execCmd(dbg *Debugger) bool {
 	fmt.Printf("ppuctrl        = %02Xh\n", ppu.ppuctrl)
 	fmt.Printf("ppumask        = %02Xh\n", ppu.ppumask)
 	fmt.Printf("ppustatus      = %02Xh\n", ppu.ppustatus)
-	fmt.Printf("ppuscrollx     = %02Xh\n", ppu.ppuscrollx)
-	fmt.Printf("ppuscrolly     = %02Xh\n", ppu.ppuscrolly)
-	fmt.Printf("ppuscrollynew  = %02Xh\n", ppu.ppuscrollynew)
-	fmt.Printf("ppuscrollw     = %t\n", ppu.ppuscrollw)
-	fmt.Printf("ppuaddr        = %02Xh\n", ppu.ppuaddr)
-	fmt.Printf("ppuaddrw       = %t\n", ppu.ppuaddrw)
+	fmt.Printf("v              = %04Xh\n", ppu.v)
+	fmt.Printf("t              = %04Xh\n", ppu.t)
+	fmt.Printf("x              = %d\n", ppu.x)
+	fmt.Printf("w              = %t\n", ppu.w)
 	fmt.Printf("ppudata        = %02Xh\n", ppu.ppudata)
+	fmt.Printf("mirroring      = %s\n", ppu.mirroring)
 	return true
 }
 
@@ -507,6 +685,66 @@ func (cmd *DbgCmdAsm) execCmd(dbg *Debugger) bool {
 	return true
 }
 
+type DbgCmdAssemble struct {
+	DbgCmdBase
+	address uint16
+	src     string
+}
+
+func NewDbgCmdAssemble(args []string) (DbgCmd, error) {
+	if len(args) < 1 {
+		return nil, errors.New("asm: invalid arguments")
+	}
+	c := new(DbgCmdAssemble)
+	if a, err := strconv.ParseUint(args[0], 16, 16); err == nil {
+		c.address = uint16(a)
+	} else {
+		return nil, errors.New("asm: invalid arguments")
+	}
+	c.src = strings.Join(args[1:], " ")
+	return c, nil
+}
+
+func (dbg *Debugger) patch(address uint16, src string) (uint16, error) {
+	prog, err := Assemble(src, address)
+	if err != nil {
+		return address, err
+	}
+	for _, seg := range prog.Segments {
+		for i, b := range seg.Code {
+			dbg.nes.mem.Poke8(seg.Org+uint16(i), b)
+		}
+		address = seg.Org + uint16(len(seg.Code))
+	}
+	return address, nil
+}
+
+// With an instruction, asm patches it at the address. Without one it
+// reads lines until an empty one, patching them one after another.
+func (cmd *DbgCmdAssemble) execCmd(dbg *Debugger) bool {
+	if cmd.src != "" {
+		if _, err := dbg.patch(cmd.address, cmd.src); err != nil {
+			fmt.Println(err)
+		}
+		return true
+	}
+
+	pc := cmd.address
+	for {
+		fmt.Printf("%04X: ", pc)
+		if !dbg.scanner.Scan() || strings.TrimSpace(dbg.scanner.Text()) == "" {
+			break
+		}
+		next, err := dbg.patch(pc, dbg.scanner.Text())
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		pc = next
+	}
+	return true
+}
+
 func dumpMem(r func(uint16) uint8, start uint16, length int) {
 	fmt.Println("      00 01 02 03 04 05 06 07 08 09 0a 0b 0c 0d 0e 0f 10 11 12 13 14 15 16 17 18 19 1a 1b 1c 1d 1e 1f")
 	fmt.Println("-----------------------------------------------------------------------------------------------------")
@@ -524,7 +762,7 @@ func dumpMem(r func(uint16) uint8, start uint16, length int) {
 }
 
 func (cmd *DbgCmdMem) execCmd(dbg *Debugger) bool {
-	r := func(a uint16) uint8 { return dbg.nes.cpu.mem.Read8(a) }
+	r := func(a uint16) uint8 { return dbg.nes.mem.Read8NoTrace(a) }
 	dumpMem(r, cmd.address, cmd.length)
 	return true
 }
@@ -548,6 +786,10 @@ func (dbg *Debugger) hook() {
 		return
 	}
 
+	if dbg.traceLog != nil {
+		dbg.traceLog.Flush()
+	}
+
 	inDebug := true
 	for inDebug {
 		fmt.Print("dbg> ")
@@ -0,0 +1,260 @@
+package nespkg
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strings"
+)
+
+//
+// NTSC composite video filter
+//
+// Rebuilds the composite signal the PPU puts out, 8 samples per pixel on
+// the 12 phase color carrier, and decodes it back the way a TV does. Luma
+// that is not fully separated from chroma gives the dot crawl and the
+// artifact colors, chroma that picks up luma edges gives the fringing.
+// The carrier phase moves by 4 samples every line and every frame.
+//
+
+const ntscSamplesPerPixel = 8
+const ntscLineSamples = ScreenSizePixX * ntscSamplesPerPixel
+
+// The output has 2 pixels per PPU pixel to keep the fringes visible.
+const NtscOutWidth = ScreenSizePixX * 2
+
+// NtscSetup follows the knobs of blargg's nes_ntsc. Sharpness, Resolution,
+// Artifacts, Fringing and Bleed go from -1 to 1 with 0 being a normal TV,
+// except that Artifacts and Fringing scale the effect and 0 turns it off.
+type NtscSetup struct {
+	PaletteParams
+	Sharpness   float64
+	Resolution  float64
+	Artifacts   float64
+	Fringing    float64
+	Bleed       float64
+	MergeFields bool
+}
+
+var NtscRF = NtscSetup{DefaultPaletteParams, -0.3, -0.4, 1.5, 1.5, 0.5, false}
+var NtscComposite = NtscSetup{DefaultPaletteParams, 0, 0, 1.0, 1.0, 0, false}
+var NtscSVideo = NtscSetup{DefaultPaletteParams, 0.2, 0.2, 0, 0, 0, false}
+var NtscRGB = NtscSetup{DefaultPaletteParams, 0.2, 0.7, 0, 0, -1, false}
+
+var ntscPresetTable = map[string]*NtscSetup{
+	"rf":        &NtscRF,
+	"composite": &NtscComposite,
+	"svideo":    &NtscSVideo,
+	"rgb":       &NtscRGB,
+}
+
+func NtscPresetByName(name string) (NtscSetup, error) {
+	s, ok := ntscPresetTable[strings.ToLower(name)]
+	if !ok {
+		return NtscSetup{}, fmt.Errorf("unknown NTSC preset: %s", name)
+	}
+	return *s, nil
+}
+
+type NtscFilter struct {
+	setup   NtscSetup
+	levels  [numPaletteColors][12]float64
+	luma    [numPaletteColors]float64
+	yKernel []float64
+	cKernel []float64
+	cos     [12]float64
+	sin     [12]float64
+	out     *image.RGBA
+	prev    *image.RGBA
+	// per line work buffers
+	pad int
+	y   []float64
+	sum []float64
+	ci  []float64
+	cq  []float64
+}
+
+func NewNtscFilter(setup NtscSetup) *NtscFilter {
+	f := new(NtscFilter)
+	f.setup = setup
+	for p := range f.levels {
+		sum := 0.0
+		for phase := 0; phase < 12; phase++ {
+			s := (ntscSignal(uint16(p), phase) - ntscBlack) / (ntscWhite - ntscBlack)
+			f.levels[p][phase] = s
+			sum += s
+		}
+		f.luma[p] = sum / 12
+	}
+	for phase := 0; phase < 12; phase++ {
+		a := ntscPhaseAngle(phase)
+		f.cos[phase] = math.Cos(a)
+		f.sin[phase] = math.Sin(a)
+	}
+
+	sigma := 3 * (1 - 0.5*setup.Resolution)
+	f.yKernel = addKernels(gaussKernel(sigma), 1+setup.Sharpness, gaussKernel(2*sigma), -setup.Sharpness)
+	// A full carrier period of box filter removes the 2x carrier left by
+	// the demodulation, the bleed then blurs chroma further.
+	f.cKernel = boxKernel(12)
+	if s := 4 * (1 + setup.Bleed); s > 0 {
+		f.cKernel = convolveKernels(f.cKernel, gaussKernel(s))
+	}
+	f.pad = len(f.yKernel)/2 + len(f.cKernel)/2 + 12
+	n := ntscLineSamples + 2*f.pad
+	f.y = make([]float64, n)
+	f.sum = make([]float64, n+1)
+	f.ci = make([]float64, n)
+	f.cq = make([]float64, n)
+	f.out = image.NewRGBA(image.Rect(0, 0, NtscOutWidth, ScreenSizePixY))
+	return f
+}
+
+func ntscPhaseAngle(phase int) float64 {
+	return math.Pi * (float64(phase) + 4) / 6
+}
+
+func gaussKernel(sigma float64) []float64 {
+	r := int(math.Ceil(2.5 * sigma))
+	k := make([]float64, 2*r+1)
+	sum := 0.0
+	for i := range k {
+		x := float64(i - r)
+		k[i] = math.Exp(-x * x / (2 * sigma * sigma))
+		sum += k[i]
+	}
+	for i := range k {
+		k[i] /= sum
+	}
+	return k
+}
+
+func boxKernel(n int) []float64 {
+	// Odd length with half weights at the ends so that it stays centered.
+	k := make([]float64, n+1)
+	for i := range k {
+		k[i] = 1 / float64(n)
+	}
+	k[0] /= 2
+	k[n] /= 2
+	return k
+}
+
+func convolveKernels(a, b []float64) []float64 {
+	k := make([]float64, len(a)+len(b)-1)
+	for i, va := range a {
+		for j, vb := range b {
+			k[i+j] += va * vb
+		}
+	}
+	return k
+}
+
+// addKernels returns wa*a + wb*b for odd length kernels, centered.
+func addKernels(a []float64, wa float64, b []float64, wb float64) []float64 {
+	if len(a) < len(b) {
+		a, wa, b, wb = b, wb, a, wa
+	}
+	k := make([]float64, len(a))
+	off := (len(a) - len(b)) / 2
+	for i := range a {
+		k[i] = wa * a[i]
+	}
+	for i := range b {
+		k[off+i] += wb * b[i]
+	}
+	return k
+}
+
+// tap applies the kernel k centered on sample n of s.
+func tap(s []float64, k []float64, n int) float64 {
+	s = s[n-len(k)/2:]
+	v := 0.0
+	for i, w := range k {
+		v += w * s[i]
+	}
+	return v
+}
+
+// Filter decodes the screen into an NtscOutWidth wide image. The image is
+// reused by the next call.
+func (f *NtscFilter) Filter(screen *[ScreenSizePixY][ScreenSizePixX]uint16, frame uint64) *image.RGBA {
+	for row := 0; row < ScreenSizePixY; row++ {
+		f.filterLine(screen[row][:], row, int(4*(uint64(row)+frame)%12))
+	}
+	if f.setup.MergeFields {
+		f.mergeFields()
+	}
+	return f.out
+}
+
+// mergeFields averages the colors of the picture with the previous one.
+// The first picture has nothing to be merged with and is kept as it is.
+func (f *NtscFilter) mergeFields() {
+	if f.prev == nil {
+		f.prev = image.NewRGBA(f.out.Rect)
+		copy(f.prev.Pix, f.out.Pix)
+		return
+	}
+	for i, v := range f.out.Pix {
+		if i%4 == 3 {
+			continue
+		}
+		p := f.prev.Pix[i]
+		f.prev.Pix[i] = v
+		f.out.Pix[i] = uint8((uint(v) + uint(p) + 1) / 2)
+	}
+}
+
+// phase returns the carrier phase of buffer sample n on a line that starts
+// at phase.
+func (f *NtscFilter) phase(phase int, n int) int {
+	return (phase + n - f.pad + 12*f.pad) % 12
+}
+
+func (f *NtscFilter) filterLine(line []uint16, row int, phase int) {
+	s := &f.setup
+	pad := f.pad
+	// Split the signal into its luma and chroma parts so that each preset
+	// can choose how much of one leaks into the other. The line is padded
+	// with its edge pixels for the filters.
+	for n := range f.y {
+		x := n - pad
+		if x < 0 {
+			x = 0
+		} else if x >= ntscLineSamples {
+			x = ntscLineSamples - 1
+		}
+		p := line[x/ntscSamplesPerPixel] % numPaletteColors
+		ph := f.phase(phase, n)
+		l := f.luma[p]
+		c := f.levels[p][ph] - l
+		f.sum[n+1] = f.sum[n] + l
+		f.y[n] = l + s.Artifacts*c
+		f.ci[n] = c
+	}
+	for n := range f.ci {
+		c := f.ci[n]
+		if s.Fringing != 0 && n >= 6 && n+6 < len(f.y) {
+			// Luma edges, the difference from a carrier period average
+			l := f.sum[n+1] - f.sum[n]
+			c += s.Fringing * (l - (f.sum[n+7]-f.sum[n-5])/12)
+		}
+		ph := f.phase(phase, n)
+		f.ci[n] = 2 * c * f.cos[ph]
+		f.cq[n] = 2 * c * f.sin[ph]
+	}
+
+	pix := f.out.Pix[row*f.out.Stride:]
+	for x := 0; x < NtscOutWidth; x++ {
+		n := pad + x*ntscSamplesPerPixel/2 + ntscSamplesPerPixel/4
+		y := tap(f.y, f.yKernel, n)
+		i := tap(f.ci, f.cKernel, n)
+		q := tap(f.cq, f.cKernel, n)
+		c := yiqToRGBA(y, i, q, s.PaletteParams)
+		pix[x*4] = c.R
+		pix[x*4+1] = c.G
+		pix[x*4+2] = c.B
+		pix[x*4+3] = c.A
+	}
+}
@@ -0,0 +1,211 @@
+package nespkg
+
+import (
+	"errors"
+	"fmt"
+)
+
+//
+// Debug view
+//
+// Switches that hide layers of the picture and overlays drawn over it. They
+// only change what is shown: sprite 0 hit and the rest of the PPU state
+// come out the same whatever is hidden. The overlays go into the screen
+// once the frame is complete, as palette colors, so they pass through the
+// frame filters like the picture.
+//
+
+type DebugView struct {
+	HideBg      bool
+	HideSprites bool
+	// BehindOnly shows only the sprites with the priority bit set, those
+	// behind the background.
+	BehindOnly    bool
+	SpriteBoxes   bool
+	AttributeGrid bool
+	Sprite0Hit    bool
+}
+
+const (
+	overlayBoxColor   = 0x2a
+	overlayLabelColor = 0x30
+	overlayGridColor  = 0x21
+	overlayHitColor   = 0x16
+)
+
+type ppuDebug struct {
+	view DebugView
+	// nametable X and Y of the first pixel of each line
+	lineScroll [ScreenSizePixY][2]uint16
+	hit        bool
+	hitCol     uint
+	hitRow     uint
+}
+
+func (v *DebugView) layers(bgPix uint8, sp *lineSprite) (uint8, *lineSprite) {
+	if v.HideBg {
+		bgPix = 0
+	}
+	if v.HideSprites || v.BehindOnly && sp != nil && sp.attr&0x20 == 0 {
+		sp = nil
+	}
+	return bgPix, sp
+}
+
+// recordLineScroll keeps where in its nametable line row starts, for the
+// attribute grid.
+func (ppu *Ppu) recordLineScroll(row uint, v uint16, fineX uint) {
+	x := (uint(v&0x1f)*tileSizePixX + fineX) & 0xff
+	y := uint(v>>5&0x1f)*tileSizePixY + uint(v>>12)
+	ppu.debug.lineScroll[row] = [2]uint16{uint16(x), uint16(y)}
+}
+
+func (ppu *Ppu) recordSprite0Hit(col uint, row uint) {
+	d := &ppu.debug
+	if !d.hit {
+		d.hit = true
+		d.hitCol = col
+		d.hitRow = row
+	}
+}
+
+func overlayDot(screen *[ScreenSizePixY][ScreenSizePixX]uint16, x int, y int, c uint16) {
+	if x >= 0 && x < ScreenSizePixX && y >= 0 && y < ScreenSizePixY {
+		screen[y][x] = c
+	}
+}
+
+// 3x5 digits for the sprite labels
+var overlayDigits = [10][5]uint8{
+	{7, 5, 5, 5, 7}, {2, 6, 2, 2, 7}, {7, 1, 7, 4, 7}, {7, 1, 7, 1, 7}, {5, 5, 7, 1, 1},
+	{7, 4, 7, 1, 7}, {7, 4, 7, 5, 7}, {7, 1, 1, 1, 1}, {7, 5, 7, 5, 7}, {7, 5, 7, 1, 7},
+}
+
+func overlayNumber(screen *[ScreenSizePixY][ScreenSizePixX]uint16, x int, y int, n int, c uint16) {
+	for i, d := range []int{n / 10, n % 10} {
+		for row := 0; row < 5; row++ {
+			for col := 0; col < 3; col++ {
+				if overlayDigits[d][row]&(4>>uint(col)) != 0 {
+					overlayDot(screen, x+i*4+col, y+row, c)
+				}
+			}
+		}
+	}
+}
+
+// drawOverlays draws the overlays of the debug view into the finished
+// frame.
+func (ppu *Ppu) drawOverlays(screen *[ScreenSizePixY][ScreenSizePixX]uint16) {
+	d := &ppu.debug
+	if d.view.AttributeGrid {
+		ppu.drawAttributeGrid(screen)
+	}
+	if d.view.SpriteBoxes {
+		ppu.drawSpriteBoxes(screen)
+	}
+	if d.view.Sprite0Hit && d.hit {
+		x, y := int(d.hitCol), int(d.hitRow)
+		for i := -3; i <= 3; i++ {
+			overlayDot(screen, x+i, y, overlayHitColor)
+			overlayDot(screen, x, y+i, overlayHitColor)
+		}
+	}
+	d.hit = false
+}
+
+// drawAttributeGrid draws solid lines around the 32x32 areas of an
+// attribute byte and dotted ones between the 16x16 palette areas.
+func (ppu *Ppu) drawAttributeGrid(screen *[ScreenSizePixY][ScreenSizePixX]uint16) {
+	for row := 0; row < ScreenSizePixY; row++ {
+		s := ppu.debug.lineScroll[row]
+		for col := 0; col < ScreenSizePixX; col++ {
+			x := (int(s[0]) + col) & 0xff
+			y := int(s[1])
+			if x%32 == 0 || y%32 == 0 || (x%16 == 0 || y%16 == 0) && (x+y)&1 == 0 {
+				screen[row][col] = overlayGridColor
+			}
+		}
+	}
+}
+
+// drawSpriteBoxes outlines the sprites in range of the screen with their
+// OAM index above them.
+func (ppu *Ppu) drawSpriteBoxes(screen *[ScreenSizePixY][ScreenSizePixX]uint16) {
+	h := ppu.spriteHeight()
+	for i := 63; i >= 0; i-- {
+		sp := ppu.getSprite(i)
+		if sp.oam[0] >= 0xef {
+			continue
+		}
+		x := int(sp.oam[3])
+		y := int(sp.oam[0]) + 1
+		for n := 0; n < tileSizePixX; n++ {
+			overlayDot(screen, x+n, y, overlayBoxColor)
+			overlayDot(screen, x+n, y+h-1, overlayBoxColor)
+		}
+		for n := 1; n < h-1; n++ {
+			overlayDot(screen, x, y+n, overlayBoxColor)
+			overlayDot(screen, x+tileSizePixX-1, y+n, overlayBoxColor)
+		}
+		ly := y - 6
+		if ly < 0 {
+			ly = y + h + 1
+		}
+		overlayNumber(screen, x, ly, i, overlayLabelColor)
+	}
+}
+
+func (nes *Nes) DebugView() DebugView {
+	return nes.ppu.debug.view
+}
+
+func (nes *Nes) SetDebugView(v DebugView) {
+	nes.ppu.debug.view = v
+}
+
+type DbgCmdDebugView struct {
+	DbgCmdBase
+}
+
+func NewDbgCmdDebugView(args []string) (DbgCmd, error) {
+	for _, a := range args {
+		if _, ok := debugViewSwitches[a]; !ok && a != "off" {
+			return nil, errors.New("view: unknown switch " + a)
+		}
+	}
+	c := new(DbgCmdDebugView)
+	c.args = args
+	return c, nil
+}
+
+var debugViewSwitches = map[string]func(v *DebugView) *bool{
+	"bg":      func(v *DebugView) *bool { return &v.HideBg },
+	"sprites": func(v *DebugView) *bool { return &v.HideSprites },
+	"behind":  func(v *DebugView) *bool { return &v.BehindOnly },
+	"boxes":   func(v *DebugView) *bool { return &v.SpriteBoxes },
+	"grid":    func(v *DebugView) *bool { return &v.AttributeGrid },
+	"hit":     func(v *DebugView) *bool { return &v.Sprite0Hit },
+}
+
+// view                  show the switches
+// view <switch>...      toggle bg, sprites, behind, boxes, grid or hit
+// view off              back to the normal picture
+func (cmd *DbgCmdDebugView) execCmd(dbg *Debugger) bool {
+	v := dbg.nes.DebugView()
+	for _, a := range cmd.args {
+		if a == "off" {
+			v = DebugView{}
+			continue
+		}
+		p := debugViewSwitches[a](&v)
+		*p = !*p
+	}
+	dbg.nes.SetDebugView(v)
+	fmt.Printf("hide bg        = %t\n", v.HideBg)
+	fmt.Printf("hide sprites   = %t\n", v.HideSprites)
+	fmt.Printf("behind only    = %t\n", v.BehindOnly)
+	fmt.Printf("sprite boxes   = %t\n", v.SpriteBoxes)
+	fmt.Printf("attribute grid = %t\n", v.AttributeGrid)
+	fmt.Printf("sprite 0 hit   = %t\n", v.Sprite0Hit)
+	return true
+}
@@ -0,0 +1,254 @@
+package nespkg
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"strings"
+)
+
+//
+// Palettes
+//
+// A Palette maps the 9-bit screen pixels (6-bit color plus the 3 emphasis
+// bits) to RGB. It can come from a .pal file, either 64 colors with the
+// emphasis worked out here or the 512 color layout that has it built in,
+// or be generated from a model of the NTSC signal.
+//
+
+const numPaletteColors = 1 << 9
+
+type Palette struct {
+	colors [numPaletteColors]color.RGBA
+}
+
+var defaultPalette = [64][3]uint8{
+	{0x7c, 0x7c, 0x7c}, {0x00, 0x00, 0xfc}, {0x00, 0x00, 0xbc}, {0x44, 0x28, 0xbc},
+	{0x94, 0x00, 0x84}, {0xa8, 0x00, 0x20}, {0xa8, 0x10, 0x00}, {0x88, 0x14, 0x00},
+	{0x50, 0x30, 0x00}, {0x00, 0x78, 0x00}, {0x00, 0x68, 0x00}, {0x00, 0x58, 0x00},
+	{0x00, 0x40, 0x58}, {0x00, 0x00, 0x00}, {0x00, 0x00, 0x00}, {0x00, 0x00, 0x00},
+	{0xbc, 0xbc, 0xbc}, {0x00, 0x78, 0xf8}, {0x00, 0x58, 0xf8}, {0x68, 0x44, 0xfc},
+	{0xd8, 0x00, 0xcc}, {0xe4, 0x00, 0x58}, {0xf8, 0x38, 0x00}, {0xe4, 0x5c, 0x10},
+	{0xac, 0x7c, 0x00}, {0x00, 0xb8, 0x00}, {0x00, 0xa8, 0x00}, {0x00, 0xa8, 0x44},
+	{0x00, 0x88, 0x88}, {0x00, 0x00, 0x00}, {0x00, 0x00, 0x00}, {0x00, 0x00, 0x00},
+	{0xf8, 0xf8, 0xf8}, {0x3c, 0xbc, 0xfc}, {0x68, 0x88, 0xfc}, {0x98, 0x78, 0xf8},
+	{0xf8, 0x78, 0xf8}, {0xf8, 0x58, 0x98}, {0xf8, 0x78, 0x58}, {0xfc, 0xa0, 0x44},
+	{0xf8, 0xb8, 0x00}, {0xb8, 0xf8, 0x18}, {0x58, 0xd8, 0x54}, {0x58, 0xf8, 0x98},
+	{0x00, 0xe8, 0xd8}, {0x78, 0x78, 0x78}, {0x00, 0x00, 0x00}, {0x00, 0x00, 0x00},
+	{0xfc, 0xfc, 0xfc}, {0xa4, 0xe4, 0xfc}, {0xb8, 0xb8, 0xf8}, {0xd8, 0xb8, 0xf8},
+	{0xf8, 0xb8, 0xf8}, {0xf8, 0xa4, 0xc0}, {0xf0, 0xd0, 0xb0}, {0xfc, 0xe0, 0xa8},
+	{0xf8, 0xd8, 0x78}, {0xd8, 0xf8, 0x78}, {0xb8, 0xf8, 0xb8}, {0xb8, 0xf8, 0xd8},
+	{0x00, 0xfc, 0xfc}, {0xf8, 0xd8, 0xf8}, {0x00, 0x00, 0x00}, {0x00, 0x00, 0x00},
+}
+
+// Each emphasis bit dims the other two color channels.
+const emphasisAttenuation = 0.746
+
+func NewDefaultPalette() *Palette {
+	return newPalette64(defaultPalette[:])
+}
+
+func newPalette64(rgb [][3]uint8) *Palette {
+	pal := new(Palette)
+	for p := range pal.colors {
+		c := rgb[p&PixelColorMask]
+		e := p >> PixelEmphasisShift
+		for ch := uint(0); ch < 3; ch++ {
+			v := float64(c[ch])
+			for bit := uint(0); bit < 3; bit++ {
+				if e&(1<<bit) != 0 && ch != bit {
+					v *= emphasisAttenuation
+				}
+			}
+			c[ch] = uint8(v)
+		}
+		pal.colors[p] = color.RGBA{c[0], c[1], c[2], 0xff}
+	}
+	return pal
+}
+
+// ParsePalette reads the contents of a .pal file: 64 RGB triplets, or 512
+// of them with the colors for each emphasis setting following the plain
+// ones.
+func ParsePalette(data []uint8) (*Palette, error) {
+	switch len(data) {
+	case 64 * 3:
+		rgb := make([][3]uint8, 64)
+		for i := range rgb {
+			copy(rgb[i][:], data[i*3:])
+		}
+		return newPalette64(rgb), nil
+	case numPaletteColors * 3:
+		pal := new(Palette)
+		for i := range pal.colors {
+			pal.colors[i] = color.RGBA{data[i*3], data[i*3+1], data[i*3+2], 0xff}
+		}
+		return pal, nil
+	}
+	return nil, fmt.Errorf("invalid palette size %d, expected 192 or 1536 bytes", len(data))
+}
+
+func LoadPalette(filename string) (*Palette, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pal, err := ParsePalette(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return pal, nil
+}
+
+// Save writes the palette in the 512 color layout.
+func (pal *Palette) Save(filename string) error {
+	data := make([]uint8, 0, numPaletteColors*3)
+	for _, c := range pal.colors {
+		data = append(data, c.R, c.G, c.B)
+	}
+	return os.WriteFile(filename, data, 0644)
+}
+
+// PaletteParams adjust a generated palette. Hue is in degrees, the others
+// are 1.0 for no change except Brightness, which is an offset.
+type PaletteParams struct {
+	Hue        float64
+	Saturation float64
+	Contrast   float64
+	Brightness float64
+	Gamma      float64
+}
+
+var DefaultPaletteParams = PaletteParams{0, 1.0, 1.0, 0, 1.0}
+
+// Composite output levels in volts for luma 0-3, for colors $x0-$xD with
+// the signal low and high.
+var ntscLevelsLow = [4]float64{0.350, 0.518, 0.962, 1.550}
+var ntscLevelsHigh = [4]float64{1.094, 1.506, 1.962, 1.962}
+
+const ntscBlack = 0.518
+const ntscWhite = 1.962
+
+// GeneratePalette decodes the composite signal the PPU puts out for each
+// pixel. The signal is a square wave over 12 phases of the color carrier,
+// the color selecting where it is high, luma its levels and emphasis
+// dimming the phases that belong to the emphasized color.
+func GeneratePalette(params PaletteParams) *Palette {
+	pal := new(Palette)
+	for p := range pal.colors {
+		var y, i, q float64
+		for phase := 0; phase < 12; phase++ {
+			s := ntscSignal(uint16(p), phase)
+			s = (s - ntscBlack) / (ntscWhite - ntscBlack)
+			a := ntscPhaseAngle(phase)
+			y += s
+			i += 2 * s * math.Cos(a)
+			q += 2 * s * math.Sin(a)
+		}
+		y /= 12
+		i /= 12
+		q /= 12
+		pal.colors[p] = yiqToRGBA(y, i, q, params)
+	}
+	return pal
+}
+
+func ntscSignal(p uint16, phase int) float64 {
+	c := int(p & 0x0f)
+	luma := int(p>>4) & 0x03
+	if c >= 0x0e {
+		luma = 1
+	}
+	inPhase := func(c int) bool { return (c+phase)%12 < 6 }
+	var s float64
+	switch {
+	case c == 0x00:
+		s = ntscLevelsHigh[luma]
+	case c >= 0x0d:
+		s = ntscLevelsLow[luma]
+	case inPhase(c):
+		s = ntscLevelsHigh[luma]
+	default:
+		s = ntscLevelsLow[luma]
+	}
+	e := p >> PixelEmphasisShift
+	if e&0x01 != 0 && inPhase(0x0c) || e&0x02 != 0 && inPhase(0x04) || e&0x04 != 0 && inPhase(0x08) {
+		s *= emphasisAttenuation
+	}
+	return s
+}
+
+func yiqToRGBA(y, i, q float64, params PaletteParams) color.RGBA {
+	if params.Hue != 0 {
+		h := params.Hue * math.Pi / 180
+		i, q = i*math.Cos(h)-q*math.Sin(h), i*math.Sin(h)+q*math.Cos(h)
+	}
+	i *= params.Saturation
+	q *= params.Saturation
+	y = y*params.Contrast + params.Brightness
+	conv := func(v float64) uint8 {
+		v = math.Max(0, math.Min(1, v))
+		if params.Gamma > 0 && params.Gamma != 1 {
+			v = math.Pow(v, 1/params.Gamma)
+		}
+		return uint8(v*255 + 0.5)
+	}
+	return color.RGBA{
+		conv(y + 0.956*i + 0.621*q),
+		conv(y - 0.272*i - 0.647*q),
+		conv(y - 1.106*i + 1.703*q),
+		0xff,
+	}
+}
+
+// NewPalette makes a palette from a .pal file name, or "ntsc" for a
+// generated one with the default parameters. An empty name gives the
+// built-in palette.
+func NewPalette(name string) (*Palette, error) {
+	switch strings.ToLower(name) {
+	case "":
+		return NewDefaultPalette(), nil
+	case "ntsc":
+		return GeneratePalette(DefaultPaletteParams), nil
+	}
+	return LoadPalette(name)
+}
+
+func (pal *Palette) Color(p uint16) color.RGBA {
+	return pal.colors[p%numPaletteColors]
+}
+
+// ToRGBA converts a PPU screen to im, which has to be at least the size of
+// the screen.
+func (pal *Palette) ToRGBA(im *image.RGBA, screen *[ScreenSizePixY][ScreenSizePixX]uint16) {
+	for y := 0; y < ScreenSizePixY; y++ {
+		row := im.Pix[y*im.Stride:]
+		for x := 0; x < ScreenSizePixX; x++ {
+			c := pal.colors[screen[y][x]%numPaletteColors]
+			row[x*4] = c.R
+			row[x*4+1] = c.G
+			row[x*4+2] = c.B
+			row[x*4+3] = c.A
+		}
+	}
+}
+
+// ScreenImage returns the screen as a new RGBA image.
+func (pal *Palette) ScreenImage(screen *[ScreenSizePixY][ScreenSizePixX]uint16) *image.RGBA {
+	im := image.NewRGBA(image.Rect(0, 0, ScreenSizePixX, ScreenSizePixY))
+	pal.ToRGBA(im, screen)
+	return im
+}
+
+func (nes *Nes) Palette() *Palette {
+	return nes.palette
+}
+
+func (nes *Nes) SetPalette(pal *Palette) {
+	nes.palette = pal
+	if c, ok := nes.filter.(*FilterChain); ok {
+		c.palette = pal
+	}
+}
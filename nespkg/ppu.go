@@ -10,7 +10,11 @@ const vramSize = 0x4000
 const vramPageShift = 8
 const vramPageSize = 1 << vramPageShift
 const vramPages = vramSize / vramPageSize
-const nullSpIndex = 255
+
+// Screen pixels hold the 6-bit palette color in bits 0-5 and the PPUMASK
+// color emphasis bits (red, green, blue) in bits 6-8.
+const PixelColorMask = 0x3f
+const PixelEmphasisShift = 6
 
 type Ppustatus struct {
 	data uint8
@@ -18,6 +22,7 @@ type Ppustatus struct {
 
 const PPUSTATUS_V = uint8(0x80)
 const PPUSTATUS_S = uint8(0x40)
+const PPUSTATUS_O = uint8(0x20)
 
 type Ppu struct {
 	ppuctrl         uint8
@@ -25,28 +30,34 @@ type Ppu struct {
 	ppustatus       uint8
 	oamaddr         uint8
 	oamdma          uint8
-	ppuscrollx      uint8
-	ppuscrollxnew   uint8
-	ppuscrolly      uint8
-	ppuscrollynew   uint8
-	ppuscrollw      bool
-	ppuaddr         uint16
+	v               uint16
+	t               uint16
+	x               uint8
+	w               bool
 	ppudata         uint8
-	ppuaddrw        bool
+	ioLatch         uint8
+	ioLatchFrame    [8]uint64
 	vram            [vramSize]uint8
 	lvram           [vramPages][]uint8
-	nametable       [4][]uint8
-	attributetable  [4][]uint8
 	oam             [4 * 64]uint8
 	bgPalette       [4][]uint8
 	spPalette       [4][]uint8
-	screen          [ScreenSizePixY][ScreenSizePixX]uint8
-	oamScreen       [ScreenSizePixY][ScreenSizePixX]uint8
-	oamBehindBg     [ScreenSizePixY][ScreenSizePixX]bool
-	oamMap          [ScreenSizePixY][ScreenSizePixX]uint8
+	screen          [ScreenSizePixY][ScreenSizePixX]uint16
+	sprites         [64]lineSprite
+	spriteCount     int
+	noSpriteLimit   bool
 	oddframe        bool
+	dotFraction     uint
 	currentScanline uint
+	lineDrawn       bool
 	clock           uint
+	frame           uint64
+	dotMode         bool
+	dotState        dotState
+	mirroring       Mirroring
+	bus             ppuBus
+	fetchDot        uint
+	debug           ppuDebug
 	nes             *Nes
 }
 
@@ -54,6 +65,7 @@ func (ppu *Ppu) writeMmapReg(address uint16, v uint8) {
 	if address == 0x4014 {
 		ppu.writeOamdma(v)
 	} else {
+		ppu.refreshIoLatch(v, 0xff)
 		switch address & 0x07 {
 		case 0:
 			ppu.writePpuctrl(v)
@@ -74,20 +86,59 @@ func (ppu *Ppu) writeMmapReg(address uint16, v uint8) {
 }
 
 func (ppu *Ppu) readMmapReg(address uint16) uint8 {
+	if address == 0x4014 {
+		return 0
+	}
 	switch address & 0x07 {
 	case 2:
-		return ppu.readPpustatus()
+		return ppu.readIoLatch(ppu.readPpustatus(), 0xe0)
 	case 4:
-		return ppu.readOamdata()
+		return ppu.readIoLatch(ppu.readOamdata(), 0xff)
 	case 7:
-		return ppu.readPpudata()
+		return ppu.readIoLatch(ppu.readPpudata())
 	}
-	return 0
+	return ppu.readIoLatch(0, 0)
+}
+
+//
+// PPU open bus
+//
+// The data bus between the CPU and the PPU registers holds the last value
+// written to or read from any register. Reads of write-only registers and
+// of unused bits return it. Each bit fades to 0 when it has not been
+// driven for about 600ms.
+//
+
+const ioLatchDecayFrames = 36
+
+func (ppu *Ppu) refreshIoLatch(v uint8, mask uint8) {
+	ppu.ioLatch = ppu.ioLatch&^mask | v&mask
+	for i := uint(0); i < 8; i++ {
+		if mask&(1<<i) != 0 {
+			ppu.ioLatchFrame[i] = ppu.frame
+		}
+	}
+}
+
+// readIoLatch puts the bits in mask of v on the bus and returns the bus.
+func (ppu *Ppu) readIoLatch(v uint8, mask uint8) uint8 {
+	for i := uint(0); i < 8; i++ {
+		if ppu.frame-ppu.ioLatchFrame[i] > ioLatchDecayFrames {
+			ppu.ioLatch &^= 1 << i
+		}
+	}
+	ppu.refreshIoLatch(v, mask)
+	return ppu.ioLatch
 }
 
 func (ppu *Ppu) writePpuctrl(v uint8) {
 	//Debug("writePpuctrl: %02Xh\n", v)
+	// Enabling NMI during vblank fires it right away.
+	if v&0x80 != 0 && !ppu.vblankNmi() && ppu.ppustatus&PPUSTATUS_V != 0 {
+		ppu.nes.mem.SetNmi()
+	}
 	ppu.ppuctrl = v
+	ppu.t = ppu.t&^0x0c00 | uint16(v&0x03)<<10
 }
 
 func (ppu *Ppu) baseNametableAddress() uint {
@@ -162,63 +213,152 @@ func (ppu *Ppu) emphasizeBlue() bool {
 	return ppu.ppumask&0x80 != 0
 }
 
+// outputPixel applies greyscale and color emphasis to a palette color.
+func (ppu *Ppu) outputPixel(c uint8) uint16 {
+	if ppu.greyscale() {
+		c &= 0x30
+	}
+	e := uint16(ppu.ppumask >> 5)
+	if ppu.nes.region.swapEmphasis {
+		e = e&0x04 | e&0x01<<1 | e&0x02>>1
+	}
+	return uint16(c&PixelColorMask) | e<<PixelEmphasisShift
+}
+
 func (ppu *Ppu) readPpustatus() uint8 {
 	v := ppu.ppustatus
 	ppu.ppustatus &= ^PPUSTATUS_V
+	ppu.w = false
+	// Reading just as vblank starts hides the flag for this frame.
+	if ppu.dotMode && ppu.currentScanline == ppu.nes.region.VblankScanline && ppu.dot() == 1 {
+		ppu.dotState.suppressVbl = true
+	}
 	//Debug("ppustatus=%02Xh\n", v)
 	return v
 }
 
+//
+// Internal scroll registers
+//
+// v and t are 15 bits: yyy NN YYYYY XXXXX
+// (fine Y, nametable select, coarse Y, coarse X). x is fine X scroll and
+// w the first/second write toggle shared by $2005 and $2006.
+//
+
 func (ppu *Ppu) writePpuscroll(v uint8) {
 	//Debug("writePpuscroll: %02Xh\n", v)
-	if ppu.ppuscrollw {
-		ppu.ppuscrollynew = v
-		ppu.ppuscrollw = false
+	if ppu.w {
+		ppu.t = ppu.t&^0x73e0 | uint16(v&0x07)<<12 | uint16(v&0xf8)<<2
+		ppu.w = false
 	} else {
-		ppu.ppuscrollxnew = v
-		ppu.ppuscrollw = true
+		ppu.t = ppu.t&^0x001f | uint16(v)>>3
+		ppu.x = v & 0x07
+		ppu.w = true
 	}
 }
 
-func (ppu *Ppu) updatePpuscrolly() {
-	ppu.ppuscrolly = ppu.ppuscrollynew
+func (ppu *Ppu) writePpuaddr(v uint8) {
+	if ppu.w {
+		ppu.t = ppu.t&0x7f00 | uint16(v)
+		ppu.v = ppu.t
+		ppu.w = false
+		ppu.busAccess(ppu.vramAddress(), ppu.dot())
+	} else {
+		ppu.t = ppu.t&0x00ff | uint16(v&0x3f)<<8
+		ppu.w = true
+	}
 }
 
-func (ppu *Ppu) writePpuaddr(v uint8) {
-	if ppu.ppuaddrw {
-		ppu.ppuaddr = ppu.ppuaddr&0xff00 | uint16(v)
-		ppu.ppuaddrw = false
+func incCoarseX(v uint16) uint16 {
+	if v&0x001f == 31 {
+		return v&^0x001f ^ 0x0400
+	}
+	return v + 1
+}
+
+func incY(v uint16) uint16 {
+	if v&0x7000 != 0x7000 {
+		return v + 0x1000
+	}
+	v &^= 0x7000
+	y := (v & 0x03e0) >> 5
+	if y == 29 {
+		y = 0
+		v ^= 0x0800
+	} else if y == 31 {
+		y = 0
 	} else {
-		ppu.ppuaddr = ppu.ppuaddr&0x00ff | uint16(v)<<8
-		ppu.ppuaddrw = true
+		y++
 	}
+	return v&^0x03e0 | y<<5
+}
+
+func (ppu *Ppu) copyHorizontal() {
+	ppu.v = ppu.v&^0x041f | ppu.t&0x041f
+}
+
+func (ppu *Ppu) copyVertical() {
+	ppu.v = ppu.v&^0x7be0 | ppu.t&0x7be0
+}
+
+func (ppu *Ppu) renderingEnabled() bool {
+	return ppu.showBg() || ppu.showSprite()
+}
+
+func (ppu *Ppu) rendering() bool {
+	return ppu.renderingEnabled() &&
+		(ppu.currentScanline <= lastVisibleScanline || ppu.currentScanline == ppu.preRenderScanline())
 }
 
+// During rendering $2007 accesses bump v the way the fetch logic does
+// instead of by 1 or 32.
 func (ppu *Ppu) incPpuaddr() {
-	if ppu.vramIncMode() == 0 {
-		ppu.ppuaddr++
+	if ppu.rendering() {
+		ppu.v = incY(incCoarseX(ppu.v))
+	} else if ppu.vramIncMode() == 0 {
+		ppu.v = (ppu.v + 1) & 0x7fff
 	} else {
-		ppu.ppuaddr += 32
+		ppu.v = (ppu.v + 32) & 0x7fff
 	}
 }
 
+func (ppu *Ppu) vramAddress() uint16 {
+	return ppu.v & 0x3fff
+}
+
 func (ppu *Ppu) writePpudata(v uint8) {
-	//Debug("ppu.ppuaddr=%04X data=%02X\n", ppu.ppuaddr, v)
-	ppu.lvram[vramPage(ppu.ppuaddr)][vramOffest(ppu.ppuaddr)] = v
+	//Debug("ppu.v=%04X data=%02X\n", ppu.v, v)
+	a := ppu.vramAddress()
+	ppu.busAccess(a, ppu.dot())
+	ppu.lvram[vramPage(a)][vramOffest(a)] = v
 	ppu.incPpuaddr()
 }
 
-func (ppu *Ppu) readPpudata() uint8 {
+// readPpudata returns the value $2007 puts on the bus and which bits of it
+// are driven. Reads below the palettes return the read buffer and refill it
+// afterwards. Palette reads return at once, with the top two bits left to
+// open bus, while the buffer is filled from the nametable underneath.
+func (ppu *Ppu) readPpudata() (uint8, uint8) {
 	var v uint8
-	if ppu.ppuaddr < 0x3f00 {
+	mask := uint8(0xff)
+	a := ppu.vramAddress()
+	ppu.busAccess(a, ppu.dot())
+	if a < 0x3f00 {
+		if ppu.nes.cdl != nil {
+			ppu.nes.cdl.logChr(a, CDL_CHR_READ)
+		}
 		v = ppu.ppudata
-		ppu.ppudata = ppu.lvram[vramPage(ppu.ppuaddr)][vramOffest(ppu.ppuaddr)]
+		ppu.ppudata = ppu.vramRead8(a)
 	} else {
-		ppu.ppudata = ppu.lvram[vramPage(ppu.ppuaddr)][vramOffest(ppu.ppuaddr)]
-		v = ppu.ppudata
+		ppu.ppudata = ppu.vramRead8(a - 0x1000)
+		v = ppu.vramRead8(a)
+		if ppu.greyscale() {
+			v &= 0x30
+		}
+		mask = 0x3f
 	}
 	ppu.incPpuaddr()
-	return v
+	return v, mask
 }
 
 func (ppu *Ppu) writeOamaddr(v uint8) {
@@ -230,16 +370,22 @@ func (ppu *Ppu) writeOamdata(v uint8) {
 	ppu.oamaddr++
 }
 
+// Bits 2-4 of sprite attributes do not exist and read back as 0.
 func (ppu *Ppu) readOamdata() uint8 {
-	return ppu.oam[ppu.oamaddr]
+	v := ppu.oam[ppu.oamaddr]
+	if ppu.oamaddr&0x03 == 2 {
+		v &= 0xe3
+	}
+	return v
 }
 
 func (ppu *Ppu) writeOamdma(hi uint8) {
 	cpuaddr := uint16(hi) << 8
 	for i := 0; i < 0x100; i++ {
-		ppu.oam[i] = ppu.nes.mem.Read8(cpuaddr)
+		ppu.oam[uint8(i)+ppu.oamaddr] = ppu.nes.mem.Read8(cpuaddr)
 		cpuaddr++
 	}
+	ppu.nes.cpu.startOamDma()
 }
 
 func (ppu *Ppu) RenderScreen() {
@@ -248,81 +394,83 @@ func (ppu *Ppu) RenderScreen() {
 	}
 }
 
+// renderScanline draws a line from v and fine X, then does what the PPU
+// does to v at dots 256 and 257: the Y increment and the horizontal copy.
 func (ppu *Ppu) renderScanline(row uint) {
-	ppu.ppuscrollx = ppu.ppuscrollxnew
-	for col := 0; col < ScreenSizePixX; col++ {
-		ppu.renderPixel(uint(col), row)
+	v := ppu.v
+	fineX := uint(ppu.x)
+	var lo, hi, paletteIndex uint8
+	fetched := false
+	ppu.recordLineScroll(row, v, fineX)
+	for col := uint(0); col < ScreenSizePixX; col++ {
+		pix := uint8(0)
+		if ppu.showBg() {
+			if !fetched {
+				ppu.fetchDot = col + 5
+				lo, hi, paletteIndex = ppu.fetchBgTile(v)
+				fetched = true
+			}
+			pix = uint8(bits(uint(lo), tileSizePixX-1-fineX, 1) | bits(uint(hi), tileSizePixX-1-fineX, 1)<<1)
+		}
+		ppu.renderPixel(col, row, pix, paletteIndex)
+		fineX++
+		if fineX == tileSizePixX {
+			fineX = 0
+			v = incCoarseX(v)
+			fetched = false
+		}
+	}
+	if ppu.renderingEnabled() {
+		ppu.v = incY(ppu.v)
+		ppu.copyHorizontal()
+		ppu.evaluateSprites(row)
 	}
 }
 
-func getIndexInNametable(x uint, y uint) uint {
-	return screenSizeTileX*((y%ScreenSizePixY)/8) + ((x % ScreenSizePixX) / 8)
-}
-
-func getPaletteIndex(attributetable []uint8, x uint, y uint) uint8 {
-	const attrMetatileSize = 32
-	const attrTileSize = 16
-	const attrMetatilesInRow = 8
-
-	u := x % ScreenSizePixX
-	v := y % ScreenSizePixY
-	index := u/attrMetatileSize + (v/attrMetatileSize)*attrMetatilesInRow
-	attr := attributetable[index]
-	s := (u / attrTileSize) % 2
-	t := (v / attrTileSize) % 2
-	return (attr >> ((s + t*2) * 2) & 0x03)
-}
-
-func getNametableIndex(x uint, y uint) uint {
-	return (x/ScreenSizePixX)%2 + ((y/ScreenSizePixY)%2)*2
-}
-
-func (ppu *Ppu) renderPixel(col uint, row uint) {
+// fetchBgTile returns the pattern bytes of the tile row v points at and its
+// palette from the attribute table.
+func (ppu *Ppu) fetchBgTile(v uint16) (uint8, uint8, uint8) {
 	const patternEntryBytes = 16
-	const tileSize = 8
 	const hiOffset = 8
 
-	if ppu.showBg() {
-		x := col + uint(ppu.ppuscrollx)
-		if ppu.ppuctrl&0x01 != 0 {
-			x += 256
-		}
-		y := row + uint(ppu.ppuscrolly)
-		if ppu.ppuctrl&0x02 != 0 {
-			y += 240
-		}
-		nametableIndex := getNametableIndex(x, y)
-		nametable := ppu.nametable[nametableIndex]
-
-		index := getIndexInNametable(x, y)
-		patternIndex := uint16(uint(nametable[index])*patternEntryBytes + y%tileSize)
-
-		lo := ppu.vramRead8(ppu.bgPatternBase() + patternIndex)
-		hi := ppu.vramRead8(ppu.bgPatternBase() + patternIndex + hiOffset)
+	tile := ppu.vramRead8(0x2000 | v&0x0fff)
+	attr := ppu.vramRead8(0x23c0 | v&0x0c00 | (v>>4)&0x38 | (v>>2)&0x07)
+	shift := (v>>4)&0x04 | v&0x02
+	fineY := v >> 12
 
-		attributetable := ppu.attributetable[nametableIndex]
-		paletteIndex := getPaletteIndex(attributetable, x, y)
+	patternIndex := ppu.bgPatternBase() + uint16(tile)*patternEntryBytes + fineY
+	lo := ppu.patternRead8(patternIndex, CDL_CHR_BG)
+	hi := ppu.patternRead8(patternIndex+hiOffset, CDL_CHR_BG)
+	return lo, hi, (attr >> shift) & 0x03
+}
 
-		pix := bits(uint(lo), tileSize-1-x%tileSize, 1) |
-			(bits(uint(hi), tileSize-1-x%tileSize, 1) << 1)
-		if pix == 0 {
-			ppu.screen[row][col] = ppu.bgPalette[0][0]
-			//Debug("ppu.bgPalette[0][0]=%02X\n", ppu.bgPalette[0][0])
-		} else {
-			ppu.screen[row][col] = ppu.bgPalette[paletteIndex][pix]
-		}
+// renderPixel puts the background pixel together with the sprites of the
+// line.
+func (ppu *Ppu) renderPixel(col uint, row uint, bgPix uint8, bgPalette uint8) {
+	if col < tileSizePixX && !ppu.showBgInLeftmost() {
+		bgPix = 0
+	}
+	spPix := uint8(0)
+	var sp *lineSprite
+	if ppu.showSprite() && (col >= tileSizePixX || ppu.showSpriteInLeftmost()) {
+		spPix, sp = ppu.spritePixel(col)
 	}
 
-	if ppu.showSprite() && ppu.oamScreen[row][col] != 0 && !(ppu.oamBehindBg[row][col] && ppu.screen[row][col] != ppu.bgPalette[0][0]) {
-		ppu.screen[row][col] = ppu.oamScreen[row][col]
+	if sp != nil && sp.index == 0 && bgPix != 0 && col != ScreenSizePixX-1 && ppu.showBg() {
+		//Debug("Sprite zero hit\n")
+		ppu.recordSprite0Hit(col, row)
+		ppu.ppustatus |= PPUSTATUS_S
 	}
+	bgPix, sp = ppu.debug.view.layers(bgPix, sp)
 
-	if ppu.ppustatus&PPUSTATUS_S == 0 && ppu.showSprite() && ppu.showBg() {
-		if ppu.oamMap[row][col] == 0 && ppu.screen[row][col] != 0 {
-			//Debug("Sprite zero hit\n")
-			ppu.ppustatus |= PPUSTATUS_S
-		}
+	c := ppu.backdrop()
+	if bgPix != 0 {
+		c = ppu.bgPalette[bgPalette][bgPix]
 	}
+	if sp != nil && (bgPix == 0 || sp.attr&0x20 == 0) {
+		c = ppu.spPalette[sp.attr&0x03][spPix]
+	}
+	ppu.screen[row][col] = ppu.outputPixel(c)
 }
 
 func vramPage(a uint16) uint {
@@ -330,11 +478,13 @@ func vramPage(a uint16) uint {
 }
 
 func vramAddressFix(a uint16) uint16 {
-	if a >= 0x3F20 && a < 0x4000 {
+	if a >= 0x3F00 && a < 0x4000 {
 		// 0x3F20-0x3FFF: mirrors of 0x3F00-0x3F1F
 		a &= 0xFF1F
-	} else if a == 0x3f10 || a == 0x3f14 || a == 0x3f18 || a == 0x3fc0 {
-		a &= 0x3f0f
+		// 0x3F10/0x3F14/0x3F18/0x3F1C: mirrors of 0x3F00/0x3F04/0x3F08/0x3F0C
+		if a&0x0013 == 0x0010 {
+			a &= 0x3f0f
+		}
 	}
 	return a
 }
@@ -357,55 +507,56 @@ func (ppu *Ppu) vramRead8(address uint16) uint8 {
 	return ppu.lvram[vramPage(address)][vramOffest(address)]
 }
 
+// patternRead8 is a pattern table fetch by the renderer at fetchDot.
+func (ppu *Ppu) patternRead8(address uint16, layer uint8) uint8 {
+	if ppu.nes.cdl != nil {
+		ppu.nes.cdl.logChr(address, CDL_CHR_DRAWN|layer)
+	}
+	ppu.busAccess(address, ppu.fetchDot)
+	return ppu.vramRead8(address)
+}
+
 func (ppu *Ppu) reset() {
-	ppu.ppuscrollx = 0
-	ppu.ppuscrolly = 0
-	ppu.ppuscrollynew = 0
-	ppu.currentScanline = preRenderScanline
+	ppu.t = 0
+	ppu.x = 0
+	ppu.w = false
+	ppu.currentScanline = ppu.preRenderScanline()
 	ppu.clock = 0
 }
 
-func toPpuClockDelta(cpuclockDelta uint) uint {
-	const ppuCpuClockRatio = 3
-	return cpuclockDelta * ppuCpuClockRatio
+// toPpuClockDelta converts CPU cycles to PPU dots, carrying the fraction
+// over on PAL where there are 3.2 dots per cycle.
+func (ppu *Ppu) toPpuClockDelta(cpuclockDelta uint) uint {
+	r := ppu.nes.region
+	dots := cpuclockDelta*r.ppuDots + ppu.dotFraction
+	ppu.dotFraction = dots % r.cpuCycles
+	return dots / r.cpuCycles
 }
 
 const firstVisibleScanline = 0
 const lastVisibleScanline = 239
 const postRenderScanline = 240
-const firstVBlankScanline = 241
-const preRenderScanline = 261
-const numScanlines = 262
+const hblankDot = 257
 
 func scanlineToClock(row uint) uint {
 	return (row + 1) * 341
 }
 
-type Sprite struct {
-	index int
-	oam   []uint8
+func (ppu *Ppu) preRenderScanline() uint {
+	return ppu.nes.region.preRenderScanline()
 }
 
-func (ppu *Ppu) getSprite(index int) *Sprite {
-	sp := new(Sprite)
-	sp.oam = ppu.oam[4*index : 4*(index+1)]
-	sp.index = index
-	return sp
+func (ppu *Ppu) dot() uint {
+	return ppu.clock - ppu.currentScanline*341
 }
 
-func (sp *Sprite) posX() int {
-	return int(sp.oam[3])
-}
-
-func (sp *Sprite) posY() int {
-	return int(sp.oam[0] + 1)
+type Sprite struct {
+	index int
+	oam   []uint8
 }
 
-func (sp *Sprite) visible() bool {
-	if sp.oam[0] >= 0xef && sp.oam[0] <= 0xff {
-		return false
-	}
-	return true
+func (ppu *Ppu) getSprite(index int) Sprite {
+	return Sprite{index, ppu.oam[4*index : 4*(index+1)]}
 }
 
 func (sp *Sprite) patternAddress(ppu *Ppu, bottomHalf bool) uint16 {
@@ -436,106 +587,170 @@ func (sp *Sprite) vFlip() bool {
 	return bits(uint(sp.oam[2]), 7, 1) == 1
 }
 
-func (ppu *Ppu) putSpriteTile(sp *Sprite, x int, y int, bottomHalf bool, behindBg bool) {
-	base := sp.patternAddress(ppu, bottomHalf)
-	for j := 0; j < 8; j++ {
-		var lo, hi uint8
-		if sp.vFlip() {
-			lo = ppu.vramRead8(base + 7 - uint16(j))
-			hi = ppu.vramRead8(base + 7 - uint16(j) + 8)
-		} else {
-			lo = ppu.vramRead8(base + uint16(j))
-			hi = ppu.vramRead8(base + uint16(j) + 8)
-		}
-		for i := 0; i < 8; i++ {
-			var pix uint
-			if sp.hFlip() {
-				pix = bits(uint(lo), uint(i%8), 1) | (bits(uint(hi), uint(i%8), 1) << 1)
-			} else {
-				pix = bits(uint(lo), uint(7-i%8), 1) | (bits(uint(hi), uint(7-i%8), 1) << 1)
-			}
-			c := uint8(0)
-			if pix != 0 {
-				c = ppu.spPalette[sp.paletteIndex()][pix]
-			}
+//
+// Sprite evaluation
+//
+// During each line the PPU picks the sprites of the next line into
+// secondary OAM, at most 8 of them, and fetches their pattern rows. A
+// sprite is drawn from the line after its Y coordinate.
+//
 
-			u := x + i
-			v := y + j
-			if c != 0 && u < ScreenSizePixX && v < ScreenSizePixY {
-				ppu.oamScreen[v][u] = c
-				ppu.oamBehindBg[v][u] = behindBg
-				ppu.oamMap[v][u] = uint8(sp.index)
-			}
-		}
+const maxSpritesPerLine = 8
+
+type lineSprite struct {
+	index int
+	x     uint8
+	attr  uint8
+	lo    uint8
+	hi    uint8
+}
+
+func (ppu *Ppu) spriteHeight() int {
+	if ppu.spriteSize8x8() {
+		return 8
 	}
+	return 16
+}
+
+func (ppu *Ppu) spriteInRange(sl uint, y uint8) bool {
+	row := int(sl) - int(y)
+	return row >= 0 && row < ppu.spriteHeight()
 }
 
-func (ppu *Ppu) preRenderSprite(spriteIndex int) {
-	sp := ppu.getSprite(spriteIndex)
-	if sp.visible() {
-		x := sp.posX()
-		y := sp.posY()
-		behindBg := sp.behindBg()
-		ppu.putSpriteTile(sp, x, y, false, behindBg)
-		if !ppu.spriteSize8x8() {
-			ppu.putSpriteTile(sp, x, y+8, true, behindBg)
+// evaluateSprites fills the sprite list with the sprites on the line after
+// sl. Without the sprite limit the list takes every sprite on the line,
+// though the overflow flag still behaves as on hardware.
+func (ppu *Ppu) evaluateSprites(sl uint) {
+	ppu.spriteCount = 0
+	n := 0
+	for ; n < 64 && ppu.spriteCount < maxSpritesPerLine; n++ {
+		if ppu.spriteInRange(sl, ppu.oam[4*n]) {
+			ppu.fetchSprite(sl, n)
+		}
+	}
+	ppu.checkSpriteOverflow(sl, n)
+	ppu.dummySpriteFetches()
+	if ppu.noSpriteLimit {
+		for ; n < 64; n++ {
+			if ppu.spriteInRange(sl, ppu.oam[4*n]) {
+				ppu.fetchSprite(sl, n)
+			}
 		}
 	}
 }
 
-func (ppu *Ppu) prepSprite() {
-	for i := 0; i < ScreenSizePixY; i++ {
-		for j := 0; j < ScreenSizePixX; j++ {
-			ppu.oamScreen[i][j] = 0
-			ppu.oamBehindBg[i][j] = false
+// checkSpriteOverflow looks for a 9th sprite from sprite n on. The PPU
+// increments the byte index along with the sprite index while it does, so
+// it compares tile numbers, attributes and X positions as Y coordinates,
+// missing some overflows and reporting some false ones.
+func (ppu *Ppu) checkSpriteOverflow(sl uint, n int) {
+	m := 0
+	for ; n < 64; n++ {
+		if ppu.spriteInRange(sl, ppu.oam[4*n+m]) {
+			ppu.ppustatus |= PPUSTATUS_O
+			return
 		}
+		m = (m + 1) & 3
 	}
+}
 
-	for i := 0; i < ScreenSizePixY; i++ {
-		for j := 0; j < ScreenSizePixX; j++ {
-			ppu.oamMap[i][j] = nullSpIndex
-		}
+// fetchSprite adds sprite n to the list. Vertical flip of 8x16 sprites
+// flips the whole 16 rows, so the halves swap.
+func (ppu *Ppu) fetchSprite(sl uint, n int) {
+	sp := ppu.getSprite(n)
+	row := int(sl) - int(sp.oam[0])
+	if sp.vFlip() {
+		row = ppu.spriteHeight() - 1 - row
+	}
+	address := sp.patternAddress(ppu, row >= 8) + uint16(row&7)
+	ppu.fetchDot = spriteFetchDot(ppu.spriteCount)
+	lo := ppu.patternRead8(address, CDL_CHR_SPRITE)
+	ppu.fetchDot += 2
+	hi := ppu.patternRead8(address+8, CDL_CHR_SPRITE)
+	if sp.hFlip() {
+		lo = reverseBits(lo)
+		hi = reverseBits(hi)
 	}
+	ppu.sprites[ppu.spriteCount] = lineSprite{n, sp.oam[3], sp.oam[2], lo, hi}
+	ppu.spriteCount++
+}
 
-	for i := 63; i >= 0; i-- {
-		ppu.preRenderSprite(i)
+func reverseBits(b uint8) uint8 {
+	b = b&0xf0>>4 | b&0x0f<<4
+	b = b&0xcc>>2 | b&0x33<<2
+	b = b&0xaa>>1 | b&0x55<<1
+	return b
+}
+
+// spritePixel returns the first opaque sprite pixel at col. Lower OAM
+// indexes win, whatever their background priority.
+func (ppu *Ppu) spritePixel(col uint) (uint8, *lineSprite) {
+	for i := 0; i < ppu.spriteCount; i++ {
+		sp := &ppu.sprites[i]
+		off := int(col) - int(sp.x)
+		if off < 0 || off >= tileSizePixX {
+			continue
+		}
+		bit := uint(7 - off)
+		pix := uint8(bits(uint(sp.lo), bit, 1) | bits(uint(sp.hi), bit, 1)<<1)
+		if pix != 0 {
+			return pix, sp
+		}
 	}
+	return 0, nil
 }
 
 func (ppu *Ppu) giveCpuClockDelta(cpuclockDelta uint) bool {
+	if ppu.dotMode {
+		frame := ppu.frame
+		ppu.runDots(ppu.toPpuClockDelta(cpuclockDelta))
+		return ppu.frame != frame
+	}
 	lvs := false
-	ppu.clock += toPpuClockDelta(cpuclockDelta)
-	for row := ppu.currentScanline; ppu.clock >= scanlineToClock(row); row++ {
-		if row >= firstVisibleScanline && row <= lastVisibleScanline {
-			ppu.renderScanline(row)
+	ppu.clock += ppu.toPpuClockDelta(cpuclockDelta)
+	for {
+		row := ppu.currentScanline
+		// Lines are drawn at once when the PPU reaches hblank, so that
+		// scroll writes in hblank show up from the next line.
+		if !ppu.lineDrawn && ppu.clock >= row*341+hblankDot {
+			ppu.lineDrawn = true
+			if row <= lastVisibleScanline {
+				ppu.renderScanline(row)
+			} else if row == ppu.preRenderScanline() && ppu.renderingEnabled() {
+				ppu.copyHorizontal()
+				ppu.copyVertical()
+				ppu.spriteCount = 0
+				if ppu.watchingBus() {
+					ppu.busAccess(ppu.bgPatternBase(), 5)
+				}
+				ppu.dummySpriteFetches()
+			}
+		}
+		if ppu.clock < scanlineToClock(row) {
+			break
 		}
 
-		if row == postRenderScanline {
+		if row == ppu.nes.region.VblankScanline-1 {
 			//Debug("firstVBlankScanline\n")
 			ppu.ppustatus |= PPUSTATUS_V
 			if ppu.vblankNmi() {
-				ppu.nes.cpu.setNmi()
+				ppu.nes.mem.SetNmi()
 			}
 		}
 
 		if row == lastVisibleScanline {
 			//Debug("lastVisibleScanline\n")
-			ppu.nes.display.Render(&ppu.screen)
+			ppu.nes.renderFrame(&ppu.screen)
+			ppu.frame++
 			lvs = true
 		}
 
-		if row == preRenderScanline-1 {
-			ppu.ppustatus &= ^(PPUSTATUS_V | PPUSTATUS_S)
-			ppu.prepSprite()
+		if row == ppu.preRenderScanline()-1 {
+			ppu.ppustatus &= ^(PPUSTATUS_V | PPUSTATUS_S | PPUSTATUS_O)
 		}
 
-		if row == preRenderScanline {
-			ppu.updatePpuscrolly()
-			ppu.currentScanline = 0
-			ppu.clock = 0
-		} else {
-			ppu.currentScanline++
-		}
+		ppu.lineDrawn = false
+		ppu.nextScanline()
 	}
 	return lvs
 }
@@ -557,68 +772,7 @@ func NewPpu(nes *Nes) *Ppu {
 }
 
 func (ppu *Ppu) PostRomLoadSetup() {
-	rom := ppu.nes.rom
-
-	//
-	// Nametable mirror
-	//
-	if rom.fourScreenVram == false {
-		Debug("Name table mirror setitng\n")
-		if rom.verticalMirror {
-			Debug("Vertical mirror setup\n")
-			for i := uint16(0); i < 0x400; i += vramPageSize {
-				ppu.lvram[vramPage(0x2800+i)] = ppu.lvram[vramPage(0x2000+i)]
-				ppu.lvram[vramPage(0x2c00+i)] = ppu.lvram[vramPage(0x2400+i)]
-			}
-		} else {
-			Debug("Horizontal mirror setup\n")
-			for i := uint16(0); i < 0x400; i += vramPageSize {
-				ppu.lvram[vramPage(0x2400+i)] = ppu.lvram[vramPage(0x2000+i)]
-				ppu.lvram[vramPage(0x2c00+i)] = ppu.lvram[vramPage(0x2800+i)]
-			}
-		}
-	}
-
-	Debug("Setting VRAM mirror\n")
-	for a := uint16(0x3000); a < 0x3f00; a += vramPageSize {
-		ppu.lvram[vramPage(a)] = ppu.lvram[vramPage(a-0x1000)]
-	}
-
-	//
-	// Map Name Tables and Attribute Tables
-	//
-	Debug("Name table slices setup\n")
-	if rom.fourScreenVram {
-		Debug("Four screens\n")
-		ppu.nametable[0] = ppu.vram[0x2000:0x23c0]
-		ppu.attributetable[0] = ppu.vram[0x23c0:0x2400]
-		ppu.nametable[1] = ppu.vram[0x2400:0x27c0]
-		ppu.attributetable[1] = ppu.vram[0x27c0:0x2800]
-		ppu.nametable[2] = ppu.vram[0x2800:0x2bc0]
-		ppu.attributetable[2] = ppu.vram[0x2bc0:0x2c00]
-		ppu.nametable[3] = ppu.vram[0x2c00:0x2fc0]
-		ppu.attributetable[3] = ppu.vram[0x2fc0:0x3000]
-	} else if rom.verticalMirror {
-		Debug("Vertical mirror\n")
-		ppu.nametable[0] = ppu.vram[0x2000:0x23c0]
-		ppu.attributetable[0] = ppu.vram[0x23c0:0x2400]
-		ppu.nametable[1] = ppu.vram[0x2400:0x27c0]
-		ppu.attributetable[1] = ppu.vram[0x27c0:0x2800]
-		ppu.nametable[2] = ppu.nametable[0]
-		ppu.attributetable[2] = ppu.attributetable[0]
-		ppu.nametable[3] = ppu.nametable[1]
-		ppu.attributetable[3] = ppu.attributetable[1]
-	} else {
-		Debug("Horizontal mirror\n")
-		ppu.nametable[0] = ppu.vram[0x2000:0x23c0]
-		ppu.attributetable[0] = ppu.vram[0x23c0:0x2400]
-		ppu.nametable[1] = ppu.nametable[0]
-		ppu.attributetable[1] = ppu.nametable[0]
-		ppu.nametable[2] = ppu.vram[0x2800:0x2bc0]
-		ppu.attributetable[2] = ppu.vram[0x2bc0:0x2c00]
-		ppu.nametable[3] = ppu.nametable[2]
-		ppu.attributetable[3] = ppu.attributetable[2]
-	}
+	ppu.SetMirroring(ppu.nes.rom.mirroring())
 
 	//
 	// Initialize Palettes
@@ -0,0 +1,112 @@
+package nespkg
+
+//
+// PPU address bus notifications
+//
+// Boards like MMC3 count scanlines by watching the PPU address bus. A
+// mapper implements whichever of the watcher interfaces it needs and the
+// PPU reports to it. The dot PPU reports pattern fetches on their dots. The
+// scanline renderer reports them when it draws a line, with the dots they
+// would have had, so counters clock on the right line but not on the exact
+// dot.
+//
+
+// PpuFetchWatcher is told every pattern table fetch of the renderer and
+// every address the CPU puts on the bus through $2006 and $2007.
+type PpuFetchWatcher interface {
+	ppuFetch(address uint16)
+}
+
+// A12Watcher is told of rises of address line A12 after it has been low
+// for a few CPU cycles, as the MMC3 filters them.
+type A12Watcher interface {
+	a12Rise()
+}
+
+// ScanlineWatcher is told at dot 0 of every scanline.
+type ScanlineWatcher interface {
+	scanlineStart(sl uint)
+}
+
+// A12 has to stay low for about 3 CPU cycles for a rise to count, which
+// keeps the rises between tiles of the same line from counting.
+const a12FilterDots = 9
+
+type ppuBus struct {
+	fetchWatcher    PpuFetchWatcher
+	a12Watcher      A12Watcher
+	scanlineWatcher ScanlineWatcher
+	// scanlines since power on and the time A12 was last seen high, in dots
+	lines   uint64
+	a12High uint64
+}
+
+func (ppu *Ppu) watchMapper(mapper Mapper) {
+	b := &ppu.bus
+	b.fetchWatcher, _ = mapper.(PpuFetchWatcher)
+	b.a12Watcher, _ = mapper.(A12Watcher)
+	b.scanlineWatcher, _ = mapper.(ScanlineWatcher)
+}
+
+// busAccess reports an access to address at dot of the current line.
+func (ppu *Ppu) busAccess(address uint16, dot uint) {
+	b := &ppu.bus
+	if b.fetchWatcher != nil {
+		b.fetchWatcher.ppuFetch(address)
+	}
+	if b.a12Watcher != nil && address&0x1000 != 0 {
+		// The scanline renderer reports the fetches of a line after the CPU
+		// accesses made during it, so time can go back within a line.
+		now := b.lines*dotsPerScanline + uint64(dot)
+		if now <= b.a12High {
+			return
+		}
+		if now-b.a12High > a12FilterDots {
+			b.a12Watcher.a12Rise()
+		}
+		b.a12High = now
+	}
+}
+
+func (ppu *Ppu) watchingBus() bool {
+	return ppu.bus.fetchWatcher != nil || ppu.bus.a12Watcher != nil
+}
+
+// spriteFetchDot is the dot of the pattern fetches for sprite slot n.
+func spriteFetchDot(n int) uint {
+	return hblankDot + 4 + uint(n)*8
+}
+
+// dummySpriteFetches reports the fetches of tile $FF the PPU makes for the
+// empty slots of the sprite list. With 8x16 sprites they land in the
+// $1000 pattern table whatever PPUCTRL says.
+func (ppu *Ppu) dummySpriteFetches() {
+	if !ppu.watchingBus() {
+		return
+	}
+	var address uint16
+	if ppu.spriteSize8x8() {
+		address = ppu.sprite8x8PatternBase() + 0xff*tileBytes
+	} else {
+		address = 0x1000 + 0xfe*tileBytes
+	}
+	for n := ppu.spriteCount; n < maxSpritesPerLine; n++ {
+		ppu.busAccess(address, spriteFetchDot(n))
+		ppu.busAccess(address+8, spriteFetchDot(n)+2)
+	}
+}
+
+// nextScanline moves on to the next line, wrapping after the pre-render
+// line.
+func (ppu *Ppu) nextScanline() {
+	if ppu.currentScanline == ppu.preRenderScanline() {
+		ppu.currentScanline = 0
+		ppu.clock = 0
+	} else {
+		ppu.currentScanline++
+	}
+	ppu.bus.lines++
+	if ppu.bus.scanlineWatcher != nil {
+		ppu.bus.scanlineWatcher.scanlineStart(ppu.currentScanline)
+	}
+}
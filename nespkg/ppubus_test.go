@@ -0,0 +1,48 @@
+package nespkg
+
+import (
+	"os"
+	"testing"
+)
+
+// busCounter is a mapper that counts what the PPU reports on its bus.
+type busCounter struct {
+	Mapper
+	rises int
+	lines int
+}
+
+func (c *busCounter) a12Rise() {
+	c.rises++
+}
+
+func (c *busCounter) scanlineStart(sl uint) {
+	c.lines++
+}
+
+// TestPpuBusWatchers counts the A12 rises and scanlines of sample1.nes,
+// which has the background at $0000 and the sprites at $1000, so A12 rises
+// once on every rendered line. Both renderers have to report the same.
+func TestPpuBusWatchers(t *testing.T) {
+	if _, err := os.Stat(benchRom); err != nil {
+		t.Skipf("%s not found", benchRom)
+	}
+	const frames = 10
+	for _, dot := range []bool{false, true} {
+		nes := NewNes(&Conf{DotPpu: dot}, &nullDisplay{})
+		if err := nes.LoadRom(benchRom); err != nil {
+			t.Fatal(err)
+		}
+		c := &busCounter{Mapper: nes.mapper}
+		nes.ppu.watchMapper(c)
+		nes.Reset()
+		nes.RunFrames(frames)
+		c.rises, c.lines = 0, 0
+		nes.RunFrames(frames)
+		t.Logf("dot %t: %d rises %d lines", dot, c.rises, c.lines)
+		if c.rises != 241*frames || c.lines != 262*frames {
+			t.Errorf("dot PPU %t: %d A12 rises and %d scanlines in %d frames, want %d and %d",
+				dot, c.rises, c.lines, frames, 241*frames, 262*frames)
+		}
+	}
+}
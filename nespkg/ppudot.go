@@ -0,0 +1,170 @@
+package nespkg
+
+//
+// Dot based PPU
+//
+// An alternative to the scanline renderer that steps the PPU one dot at a
+// time: background tiles go through the fetch cycle into shift registers,
+// sprites for the next line are evaluated into secondary OAM at dot 257,
+// and vblank and sprite 0 hit happen on their exact dots. It is slower but
+// mid-line register writes land where they do on hardware.
+//
+
+const dotsPerScanline = 341
+
+type dotState struct {
+	ntLatch     uint8
+	atLatch     uint8
+	loLatch     uint8
+	hiLatch     uint8
+	bgShiftLo   uint16
+	bgShiftHi   uint16
+	atShiftLo   uint16
+	atShiftHi   uint16
+	suppressVbl bool
+}
+
+func (ppu *Ppu) runDots(dots uint) {
+	for i := uint(0); i < dots; i++ {
+		ppu.stepDot()
+	}
+}
+
+func (ppu *Ppu) stepDot() {
+	sl := ppu.currentScanline
+	dot := ppu.dot()
+	ppu.fetchDot = dot
+	visible := sl <= lastVisibleScanline
+	pre := sl == ppu.preRenderScanline()
+
+	if ppu.renderingEnabled() && (visible || pre) {
+		ppu.stepBg(sl, dot)
+		if dot == hblankDot {
+			if visible {
+				ppu.evaluateSprites(sl)
+			} else {
+				ppu.spriteCount = 0
+				ppu.dummySpriteFetches()
+			}
+		}
+	} else if visible && dot >= 1 && dot <= ScreenSizePixX {
+		ppu.screen[sl][dot-1] = ppu.outputPixel(ppu.backdrop())
+	}
+
+	if sl == postRenderScanline && dot == 0 {
+		ppu.nes.renderFrame(&ppu.screen)
+		ppu.frame++
+	}
+	if sl == ppu.nes.region.VblankScanline && dot == 1 {
+		if !ppu.dotState.suppressVbl {
+			ppu.ppustatus |= PPUSTATUS_V
+			if ppu.vblankNmi() {
+				ppu.nes.mem.SetNmi()
+			}
+		}
+		ppu.dotState.suppressVbl = false
+	}
+	if pre && dot == 1 {
+		ppu.ppustatus &= ^(PPUSTATUS_V | PPUSTATUS_S | PPUSTATUS_O)
+	}
+
+	ppu.clock++
+	// The pre-render line is one dot shorter on odd frames while rendering.
+	if pre && dot == dotsPerScanline-2 && ppu.oddframe && ppu.renderingEnabled() && ppu.nes.region.oddFrameSkip {
+		ppu.clock++
+	}
+	if ppu.clock >= scanlineToClock(sl) {
+		if pre {
+			ppu.oddframe = !ppu.oddframe
+		}
+		ppu.nextScanline()
+	}
+}
+
+func (ppu *Ppu) stepBg(sl uint, dot uint) {
+	fetch := (dot >= 1 && dot <= ScreenSizePixX) || (dot >= 321 && dot <= 336)
+
+	if (dot >= 2 && dot <= hblankDot) || (dot >= 322 && dot <= 337) {
+		ppu.shiftBg()
+		if dot%8 == 1 {
+			ppu.reloadBg()
+		}
+	}
+
+	if fetch {
+		switch dot % 8 {
+		case 1:
+			ppu.dotState.ntLatch = ppu.vramRead8(0x2000 | ppu.v&0x0fff)
+		case 3:
+			v := ppu.v
+			attr := ppu.vramRead8(0x23c0 | v&0x0c00 | (v>>4)&0x38 | (v>>2)&0x07)
+			ppu.dotState.atLatch = (attr >> ((v>>4)&0x04 | v&0x02)) & 0x03
+		case 5:
+			ppu.dotState.loLatch = ppu.patternRead8(ppu.bgTileAddress(), CDL_CHR_BG)
+		case 7:
+			ppu.dotState.hiLatch = ppu.patternRead8(ppu.bgTileAddress()+8, CDL_CHR_BG)
+		case 0:
+			ppu.v = incCoarseX(ppu.v)
+		}
+	}
+
+	if sl <= lastVisibleScanline && dot >= 1 && dot <= ScreenSizePixX {
+		ppu.drawDot(sl, dot-1)
+	}
+
+	if dot == ScreenSizePixX {
+		ppu.v = incY(ppu.v)
+	}
+	if dot == hblankDot {
+		ppu.copyHorizontal()
+	}
+	if sl == ppu.preRenderScanline() && dot >= 280 && dot <= 304 {
+		ppu.copyVertical()
+	}
+}
+
+func (ppu *Ppu) bgTileAddress() uint16 {
+	return ppu.bgPatternBase() + uint16(ppu.dotState.ntLatch)*16 + ppu.v>>12
+}
+
+func (ppu *Ppu) shiftBg() {
+	s := &ppu.dotState
+	s.bgShiftLo <<= 1
+	s.bgShiftHi <<= 1
+	s.atShiftLo <<= 1
+	s.atShiftHi <<= 1
+}
+
+func (ppu *Ppu) reloadBg() {
+	s := &ppu.dotState
+	s.bgShiftLo = s.bgShiftLo&0xff00 | uint16(s.loLatch)
+	s.bgShiftHi = s.bgShiftHi&0xff00 | uint16(s.hiLatch)
+	s.atShiftLo = s.atShiftLo & 0xff00
+	s.atShiftHi = s.atShiftHi & 0xff00
+	if s.atLatch&0x01 != 0 {
+		s.atShiftLo |= 0x00ff
+	}
+	if s.atLatch&0x02 != 0 {
+		s.atShiftHi |= 0x00ff
+	}
+}
+
+func (ppu *Ppu) backdrop() uint8 {
+	return ppu.bgPalette[0][0]
+}
+
+func (ppu *Ppu) drawDot(row uint, col uint) {
+	s := &ppu.dotState
+	bgPix := uint8(0)
+	bgPalette := uint8(0)
+	if col == 0 {
+		// v is two tiles ahead of the pixels from the prefetch
+		ppu.recordLineScroll(row, ppu.v, uint(ppu.x)+ScreenSizePixX-2*tileSizePixX)
+	}
+	if ppu.showBg() {
+		bit := uint(15 - ppu.x)
+		bgPix = uint8(bits(uint(s.bgShiftLo), bit, 1) | bits(uint(s.bgShiftHi), bit, 1)<<1)
+		bgPalette = uint8(bits(uint(s.atShiftLo), bit, 1) | bits(uint(s.atShiftHi), bit, 1)<<1)
+	}
+	ppu.renderPixel(col, row, bgPix, bgPalette)
+}
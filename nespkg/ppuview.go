@@ -0,0 +1,238 @@
+package nespkg
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"strconv"
+)
+
+//
+// PPU viewer
+//
+// Renders what is in PPU memory right now, the way the PPU would fetch it,
+// into images for debugging graphics.
+//
+
+const (
+	tileBytes        = 16
+	nametableTilesX  = 32
+	nametableTilesY  = 30
+	attributeTableAt = 0x3c0
+)
+
+func (ppu *Ppu) paletteColor(pal *Palette, entry uint16) color.RGBA {
+	return pal.Color(uint16(ppu.vramRead8(0x3f00+entry) & PixelColorMask))
+}
+
+// drawTile draws the 8x8 tile at pattern address addr with palette 0-7
+// (4-7 being the sprite palettes). Pixels of color 0 are left alone when
+// transparent is set.
+func (ppu *Ppu) drawTile(im *image.RGBA, pal *Palette, x0 int, y0 int, addr uint16, palette int, hflip bool, vflip bool, transparent bool) {
+	for row := 0; row < tileSizePixY; row++ {
+		r := uint16(row)
+		if vflip {
+			r = tileSizePixY - 1 - r
+		}
+		lo := ppu.vramRead8(addr + r)
+		hi := ppu.vramRead8(addr + r + 8)
+		for col := 0; col < tileSizePixX; col++ {
+			bit := uint(tileSizePixX - 1 - col)
+			if hflip {
+				bit = uint(col)
+			}
+			pix := bits(uint(lo), bit, 1) | bits(uint(hi), bit, 1)<<1
+			if pix == 0 && transparent {
+				continue
+			}
+			entry := uint16(palette*4) + uint16(pix)
+			if pix == 0 {
+				entry = 0
+			}
+			im.SetRGBA(x0+col, y0+row, ppu.paletteColor(pal, entry))
+		}
+	}
+}
+
+// NametableImage draws the four nametables, 512x480. With scroll set the
+// area the next frame starts from, taken from t and fine X, is outlined.
+func (nes *Nes) NametableImage(scroll bool) *image.RGBA {
+	ppu := nes.ppu
+	const w = 2 * ScreenSizePixX
+	const h = 2 * ScreenSizePixY
+	im := image.NewRGBA(image.Rect(0, 0, w, h))
+	for nt := 0; nt < 4; nt++ {
+		base := uint16(0x2000 + nt*0x400)
+		x0 := (nt & 1) * ScreenSizePixX
+		y0 := (nt >> 1) * ScreenSizePixY
+		for ty := 0; ty < nametableTilesY; ty++ {
+			for tx := 0; tx < nametableTilesX; tx++ {
+				tile := ppu.vramRead8(base + uint16(ty*nametableTilesX+tx))
+				attr := ppu.vramRead8(base + attributeTableAt + uint16(ty/4*8+tx/4))
+				shift := uint((ty&0x02)<<1 | tx&0x02)
+				palette := int(attr>>shift) & 0x03
+				addr := ppu.bgPatternBase() + uint16(tile)*tileBytes
+				ppu.drawTile(im, nes.palette, x0+tx*tileSizePixX, y0+ty*tileSizePixY, addr, palette, false, false, false)
+			}
+		}
+	}
+	if scroll {
+		t := ppu.t
+		sx := int(t>>10&1)*ScreenSizePixX + int(t&0x1f)*tileSizePixX + int(ppu.x)
+		sy := int(t>>11&1)*ScreenSizePixY + int(t>>5&0x1f)*tileSizePixY + int(t>>12&0x07)
+		outline := func(x, y int) {
+			x = (x + w) % w
+			y = (y + h) % h
+			c := im.RGBAAt(x, y)
+			im.SetRGBA(x, y, color.RGBA{^c.R, ^c.G, ^c.B, 0xff})
+		}
+		for i := 0; i < ScreenSizePixX; i++ {
+			outline(sx+i, sy)
+			outline(sx+i, sy+ScreenSizePixY-1)
+		}
+		for i := 1; i < ScreenSizePixY-1; i++ {
+			outline(sx, sy+i)
+			outline(sx+ScreenSizePixX-1, sy+i)
+		}
+	}
+	return im
+}
+
+// PatternTableImage draws both pattern tables side by side, 256x128, with
+// palette 0-7.
+func (nes *Nes) PatternTableImage(palette int) *image.RGBA {
+	ppu := nes.ppu
+	im := image.NewRGBA(image.Rect(0, 0, 256, 128))
+	for table := 0; table < 2; table++ {
+		for tile := 0; tile < 256; tile++ {
+			addr := uint16(table*0x1000 + tile*tileBytes)
+			x := table*128 + tile%16*tileSizePixX
+			y := tile / 16 * tileSizePixY
+			ppu.drawTile(im, nes.palette, x, y, addr, palette&0x07, false, false, false)
+		}
+	}
+	return im
+}
+
+// OamImage draws the 64 sprites in OAM order, 8 to a row, each in a cell
+// big enough for 8x16 sprites on the backdrop color.
+func (nes *Nes) OamImage() *image.RGBA {
+	ppu := nes.ppu
+	const cellW = 12
+	const cellH = 20
+	im := image.NewRGBA(image.Rect(0, 0, 8*cellW, 8*cellH))
+	bg := ppu.paletteColor(nes.palette, 0)
+	for y := 0; y < im.Rect.Dy(); y++ {
+		for x := 0; x < im.Rect.Dx(); x++ {
+			im.SetRGBA(x, y, bg)
+		}
+	}
+	for i := 0; i < 64; i++ {
+		sp := ppu.getSprite(i)
+		x := i%8*cellW + 2
+		y := i/8*cellH + 2
+		palette := 4 + sp.paletteIndex()
+		if ppu.spriteSize8x8() {
+			ppu.drawTile(im, nes.palette, x, y, sp.patternAddress(ppu, false), palette, sp.hFlip(), sp.vFlip(), true)
+		} else {
+			top, bottom := sp.patternAddress(ppu, false), sp.patternAddress(ppu, true)
+			if sp.vFlip() {
+				top, bottom = bottom, top
+			}
+			ppu.drawTile(im, nes.palette, x, y, top, palette, sp.hFlip(), sp.vFlip(), true)
+			ppu.drawTile(im, nes.palette, x, y+tileSizePixY, bottom, palette, sp.hFlip(), sp.vFlip(), true)
+		}
+	}
+	return im
+}
+
+// PaletteImage draws the background palettes over the sprite palettes in
+// 16x16 swatches.
+func (nes *Nes) PaletteImage() *image.RGBA {
+	const swatch = 16
+	im := image.NewRGBA(image.Rect(0, 0, 16*swatch, 2*swatch))
+	for entry := 0; entry < 32; entry++ {
+		c := nes.ppu.paletteColor(nes.palette, uint16(entry))
+		x0 := entry % 16 * swatch
+		y0 := entry / 16 * swatch
+		for y := 0; y < swatch; y++ {
+			for x := 0; x < swatch; x++ {
+				im.SetRGBA(x0+x, y0+y, c)
+			}
+		}
+	}
+	return im
+}
+
+func SavePng(filename string, im image.Image) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, im); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (nes *Nes) printOam() {
+	fmt.Println("#   y   tile attr x")
+	for i := 0; i < 64; i++ {
+		sp := nes.ppu.getSprite(i)
+		fmt.Printf("%02d  %02X  %02X   %02X   %02X\n", i, sp.oam[0], sp.oam[1], sp.oam[2], sp.oam[3])
+	}
+}
+
+type DbgCmdPpuView struct {
+	DbgCmdBase
+}
+
+func NewDbgCmdPpuView(args []string) (DbgCmd, error) {
+	if len(args) < 1 || len(args) > 3 {
+		return nil, errors.New("pv: invalid arguments")
+	}
+	c := new(DbgCmdPpuView)
+	c.args = args
+	return c, nil
+}
+
+// pv nt <file>          nametables with the scroll window
+// pv pt <file> [pal]    pattern tables with palette 0-7
+// pv oam [file]         list the sprites, or draw them
+// pv pal <file>         palettes
+func (cmd *DbgCmdPpuView) execCmd(dbg *Debugger) bool {
+	nes := dbg.nes
+	args := cmd.args
+	var im image.Image
+	switch {
+	case args[0] == "oam" && len(args) == 1:
+		nes.printOam()
+		return true
+	case args[0] == "nt" && len(args) == 2:
+		im = nes.NametableImage(true)
+	case args[0] == "pt" && len(args) == 2:
+		im = nes.PatternTableImage(0)
+	case args[0] == "pt" && len(args) == 3:
+		pal, err := strconv.Atoi(args[2])
+		if err != nil || pal < 0 || pal > 7 {
+			fmt.Println("pv: palette is 0-7")
+			return true
+		}
+		im = nes.PatternTableImage(pal)
+	case args[0] == "oam" && len(args) == 2:
+		im = nes.OamImage()
+	case args[0] == "pal" && len(args) == 2:
+		im = nes.PaletteImage()
+	default:
+		fmt.Println("pv: invalid arguments")
+		return true
+	}
+	if err := SavePng(args[1], im); err != nil {
+		fmt.Println(err)
+	}
+	return true
+}
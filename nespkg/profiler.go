@@ -0,0 +1,320 @@
+package nespkg
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+)
+
+//
+// CPU profiler
+//
+// Cycles are charged to the PC of the instruction (or interrupt entry) that
+// spent them and to the routine on top of the call stack. Routines are
+// entered by JSR, NMI and IRQ and left when the stack pointer climbs back
+// to where it was before the call, which covers RTS, RTI and code that
+// drops return addresses from the stack.
+//
+
+type ProfRoutine struct {
+	Address   uint16
+	Nmi       bool
+	Irq       bool
+	Calls     uint64
+	Inclusive uint64
+	Exclusive uint64
+	active    int
+}
+
+type profFrame struct {
+	routine *ProfRoutine
+	sp      uint
+	entry   uint64
+}
+
+type Profiler struct {
+	routines    map[uint16]*ProfRoutine
+	pcCycles    [0x10000]uint64
+	stack       []profFrame
+	pc          uint16
+	cycles      uint64
+	startCycles uint64
+	pendingCall bool
+	callTarget  uint16
+	callSp      uint
+	frame       func() uint64
+	vblank      uint64
+	startFrame  uint64
+	nmiCalls    uint64
+	nmiCycles   uint64
+	nmiMax      uint64
+}
+
+// NewProfiler makes a profiler for cpu. frame returns the current video
+// frame count, used to give figures per frame, and vblank is the CPU cycles
+// in vblank the NMI handler is measured against.
+func NewProfiler(cpu *Cpu, frame func() uint64, vblank uint64) *Profiler {
+	prof := new(Profiler)
+	prof.frame = frame
+	prof.vblank = vblank
+	prof.Reset(cpu)
+	return prof
+}
+
+// Reset clears the figures. The routine running now becomes the bottom of
+// the call stack.
+func (prof *Profiler) Reset(cpu *Cpu) {
+	prof.routines = make(map[uint16]*ProfRoutine)
+	for i := range prof.pcCycles {
+		prof.pcCycles[i] = 0
+	}
+	root := prof.routine(cpu.pc)
+	root.Calls = 1
+	root.active = 1
+	prof.stack = []profFrame{{root, 0x200, cpu.cycles}}
+	prof.pc = cpu.pc
+	prof.cycles = cpu.cycles
+	prof.startCycles = cpu.cycles
+	prof.pendingCall = false
+	prof.startFrame = prof.frame()
+	prof.nmiCalls = 0
+	prof.nmiCycles = 0
+	prof.nmiMax = 0
+}
+
+func (prof *Profiler) routine(address uint16) *ProfRoutine {
+	r, ok := prof.routines[address]
+	if !ok {
+		r = &ProfRoutine{Address: address}
+		prof.routines[address] = r
+	}
+	return r
+}
+
+func (prof *Profiler) top() *profFrame {
+	return &prof.stack[len(prof.stack)-1]
+}
+
+func (prof *Profiler) enter(cpu *Cpu, address uint16, sp uint) *ProfRoutine {
+	r := prof.routine(address)
+	r.Calls++
+	r.active++
+	prof.stack = append(prof.stack, profFrame{r, sp, cpu.cycles})
+	return r
+}
+
+func (prof *Profiler) leave(cpu *Cpu) {
+	f := prof.top()
+	r := f.routine
+	inclusive := cpu.cycles - f.entry
+	r.active--
+	if r.active == 0 {
+		r.Inclusive += inclusive
+	}
+	if r.Nmi {
+		prof.nmiCalls++
+		prof.nmiCycles += inclusive
+		if inclusive > prof.nmiMax {
+			prof.nmiMax = inclusive
+		}
+	}
+	prof.stack = prof.stack[:len(prof.stack)-1]
+}
+
+// account is called before each instruction or interrupt entry. It charges
+// the cycles spent since the last call and updates the call stack.
+func (prof *Profiler) account(cpu *Cpu) {
+	delta := cpu.cycles - prof.cycles
+	prof.cycles = cpu.cycles
+	prof.pcCycles[prof.pc] += delta
+	prof.top().routine.Exclusive += delta
+
+	for len(prof.stack) > 1 && uint(cpu.s) >= prof.top().sp {
+		prof.leave(cpu)
+	}
+	if prof.pendingCall {
+		prof.pendingCall = false
+		prof.enter(cpu, prof.callTarget, prof.callSp)
+	}
+	prof.pc = cpu.pc
+}
+
+func (prof *Profiler) inst(cpu *Cpu, inst *Inst) {
+	if inst.mnemonic == "jsr" {
+		prof.pendingCall = true
+		prof.callTarget = getAddrAbs(cpu)
+		prof.callSp = uint(cpu.s)
+	}
+}
+
+// interrupt is called after the CPU has taken an interrupt. The entry
+// cycles are charged to the handler.
+func (prof *Profiler) interrupt(cpu *Cpu, vector uint16) {
+	r := prof.enter(cpu, cpu.pc, uint(cpu.s)+3)
+	r.Nmi = vector == VEC_NMI
+	r.Irq = vector == VEC_IRQ
+	prof.pc = cpu.pc
+}
+
+func (prof *Profiler) Routines() []*ProfRoutine {
+	var rs []*ProfRoutine
+	for _, r := range prof.routines {
+		rs = append(rs, r)
+	}
+	sort.Slice(rs, func(i, j int) bool {
+		if rs[i].Exclusive != rs[j].Exclusive {
+			return rs[i].Exclusive > rs[j].Exclusive
+		}
+		return rs[i].Address < rs[j].Address
+	})
+	return rs
+}
+
+// Report writes the top routines and PC addresses by exclusive cycles,
+// with figures averaged per frame.
+func (prof *Profiler) Report(w io.Writer, top int) {
+	frames := prof.frame() - prof.startFrame
+	if frames == 0 {
+		frames = 1
+	}
+	total := prof.cycles - prof.startCycles
+	perFrame := func(v uint64) float64 { return float64(v) / float64(frames) }
+	pct := func(v uint64, of uint64) float64 {
+		if of == 0 {
+			return 0
+		}
+		return float64(v) * 100 / float64(of)
+	}
+
+	fmt.Fprintf(w, "profile: %d frames, %d cycles, %.1f cycles/frame\n", frames, total, perFrame(total))
+	if prof.nmiCalls > 0 {
+		avg := prof.nmiCycles / prof.nmiCalls
+		fmt.Fprintf(w, "NMI: %d calls, avg %d cycles (%.1f%% of vblank), max %d cycles (%.1f%% of vblank)\n",
+			prof.nmiCalls, avg, pct(avg, prof.vblank), prof.nmiMax, pct(prof.nmiMax, prof.vblank))
+	}
+
+	// Routines still on the stack are counted up to now.
+	running := make(map[*ProfRoutine]uint64)
+	for _, f := range prof.stack {
+		if _, ok := running[f.routine]; !ok {
+			running[f.routine] = prof.cycles - f.entry
+		}
+	}
+
+	fmt.Fprintln(w, "routine     calls/frame   incl/frame  incl%   excl/frame  excl%")
+	for i, r := range prof.Routines() {
+		if i >= top {
+			break
+		}
+		kind := "     "
+		if r.Nmi {
+			kind = " nmi "
+		} else if r.Irq {
+			kind = " irq "
+		}
+		inclusive := r.Inclusive + running[r]
+		fmt.Fprintf(w, "$%04X%s %12.1f %12.1f %5.1f%% %12.1f %5.1f%%\n",
+			r.Address, kind, perFrame(r.Calls),
+			perFrame(inclusive), pct(inclusive, total),
+			perFrame(r.Exclusive), pct(r.Exclusive, total))
+	}
+
+	type pcCycle struct {
+		pc     uint16
+		cycles uint64
+	}
+	var pcs []pcCycle
+	for pc, c := range prof.pcCycles {
+		if c != 0 {
+			pcs = append(pcs, pcCycle{uint16(pc), c})
+		}
+	}
+	sort.Slice(pcs, func(i, j int) bool { return pcs[i].cycles > pcs[j].cycles })
+	fmt.Fprintln(w, "pc          cycles/frame  cycles%")
+	for i, p := range pcs {
+		if i >= top {
+			break
+		}
+		fmt.Fprintf(w, "$%04X       %12.1f  %5.1f%%\n", p.pc, perFrame(p.cycles), pct(p.cycles, total))
+	}
+}
+
+func (nes *Nes) EnableProfiler() *Profiler {
+	if nes.profiler == nil {
+		nes.profiler = NewProfiler(nes.cpu, func() uint64 { return nes.ppu.frame },
+			nes.region.vblankCpuCycles())
+		nes.cpu.SetProfiler(nes.profiler)
+	}
+	return nes.profiler
+}
+
+func (nes *Nes) DisableProfiler() {
+	nes.profiler = nil
+	nes.cpu.SetProfiler(nil)
+}
+
+func (nes *Nes) Profiler() *Profiler {
+	return nes.profiler
+}
+
+// ProfReportTop is how many routines the profile reports list.
+const ProfReportTop = 20
+
+// profileFrame prints and restarts the profile every profileFrames frames.
+func (nes *Nes) profileFrame() {
+	if nes.profiler == nil || nes.profileFrames == 0 {
+		return
+	}
+	if nes.ppu.frame-nes.profiler.startFrame >= uint64(nes.profileFrames) {
+		nes.profiler.Report(os.Stdout, ProfReportTop)
+		nes.profiler.Reset(nes.cpu)
+	}
+}
+
+type DbgCmdProfile struct {
+	DbgCmdBase
+	top int
+}
+
+func NewDbgCmdProfile(args []string) (DbgCmd, error) {
+	c := new(DbgCmdProfile)
+	c.top = ProfReportTop
+	c.args = args
+	if len(args) == 1 {
+		if n, err := strconv.Atoi(args[0]); err == nil {
+			c.top = n
+			c.args = nil
+		}
+	} else if len(args) > 1 {
+		return nil, errors.New("prof: invalid arguments")
+	}
+	return c, nil
+}
+
+// prof [n]      show the top n routines, enabling the profiler if needed
+// prof reset    restart profiling
+// prof off      disable the profiler
+func (cmd *DbgCmdProfile) execCmd(dbg *Debugger) bool {
+	nes := dbg.nes
+	if len(cmd.args) == 1 && cmd.args[0] == "off" {
+		nes.DisableProfiler()
+		return true
+	}
+	if nes.profiler == nil {
+		nes.EnableProfiler()
+		fmt.Println("profiler enabled")
+		return true
+	}
+	switch {
+	case len(cmd.args) == 0:
+		nes.profiler.Report(os.Stdout, cmd.top)
+	case cmd.args[0] == "reset":
+		nes.profiler.Reset(nes.cpu)
+	default:
+		fmt.Println("prof: invalid arguments")
+	}
+	return true
+}
@@ -0,0 +1,109 @@
+package nespkg
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+//
+// TV system timing
+//
+
+type Region struct {
+	Name      string
+	CpuHz     uint
+	FrameRate float64
+	// Scanlines per frame, the last one being the pre-render line
+	Scanlines uint
+	// Scanline where vblank starts and NMI fires
+	VblankScanline uint
+	// PPU dots per CPU cycle, as a fraction
+	ppuDots      uint
+	cpuCycles    uint
+	oddFrameSkip bool
+	// PPUMASK bits 5 and 6 emphasize green and red instead of red and green
+	swapEmphasis bool
+	// CPU cycles of the APU frame counter steps, the first four for 4-step
+	// mode, the last the final step of 5-step mode
+	apuFrameSteps [5]uint
+}
+
+var RegionNtsc = &Region{
+	Name:           "NTSC",
+	CpuHz:          1789773,
+	FrameRate:      60.0988,
+	Scanlines:      262,
+	VblankScanline: 241,
+	ppuDots:        3,
+	cpuCycles:      1,
+	oddFrameSkip:   true,
+	apuFrameSteps:  [5]uint{7457, 14913, 22371, 29829, 37281},
+}
+
+var RegionPal = &Region{
+	Name:           "PAL",
+	CpuHz:          1662607,
+	FrameRate:      50.0070,
+	Scanlines:      312,
+	VblankScanline: 241,
+	ppuDots:        16,
+	cpuCycles:      5,
+	swapEmphasis:   true,
+	apuFrameSteps:  [5]uint{8313, 16627, 24939, 33253, 41565},
+}
+
+// Dendy is a PAL famiclone that keeps NTSC's 3:1 clock ratio and 20 vblank
+// lines, sitting idle for 50 lines after the picture instead.
+var RegionDendy = &Region{
+	Name:           "Dendy",
+	CpuHz:          1773448,
+	FrameRate:      50.0070,
+	Scanlines:      312,
+	VblankScanline: 291,
+	ppuDots:        3,
+	cpuCycles:      1,
+	swapEmphasis:   true,
+	apuFrameSteps:  [5]uint{7457, 14913, 22371, 29829, 37281},
+}
+
+var regionTable = map[string]*Region{
+	"ntsc":  RegionNtsc,
+	"pal":   RegionPal,
+	"dendy": RegionDendy,
+}
+
+func RegionByName(name string) (*Region, error) {
+	r, ok := regionTable[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown region: %s", name)
+	}
+	return r, nil
+}
+
+func (r *Region) preRenderScanline() uint {
+	return r.Scanlines - 1
+}
+
+func (r *Region) framePeriod() time.Duration {
+	return time.Duration(float64(time.Second) / r.FrameRate)
+}
+
+// vblankCpuCycles is the time from the start of vblank to the pre-render
+// line, which is what an NMI handler has for VRAM updates.
+func (r *Region) vblankCpuCycles() uint64 {
+	lines := r.preRenderScanline() - r.VblankScanline
+	return uint64(lines * dotsPerScanline * r.cpuCycles / r.ppuDots)
+}
+
+// region returns the timing the ROM header asks for. Multi-region ROMs
+// run as NTSC.
+func (rom *NesRom) region() *Region {
+	switch rom.tvSystem {
+	case 1:
+		return RegionPal
+	case 3:
+		return RegionDendy
+	}
+	return RegionNtsc
+}
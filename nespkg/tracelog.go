@@ -0,0 +1,195 @@
+package nespkg
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+//
+// Nintendulator/nestest compatible trace log
+//
+// C000  4C F5 C5  JMP $C5F5                       A:00 X:00 Y:00 P:24 SP:FD PPU:  0, 21 CYC:7
+//
+
+// Mnemonics that nestest.log spells differently
+var nestestMnemonic = map[string]string{
+	"isc": "isb",
+}
+
+func (cpu *Cpu) peek8(address uint16) uint8 {
+	return cpu.bus.Peek8(address)
+}
+
+func (cpu *Cpu) peek16Zp(zp uint8) uint16 {
+	return uint16(cpu.peek8(uint16(zp))) | uint16(cpu.peek8(uint16(zp+1)))<<8
+}
+
+func (cpu *Cpu) getTraceOpdString(opc uint8, pc uint16) string {
+	p := instTable[opc]
+	b1 := cpu.peek8(pc + 1)
+	w := uint16(b1) | uint16(cpu.peek8(pc+2))<<8
+
+	switch p.mode {
+	case acc:
+		return "A"
+	case imm:
+		return fmt.Sprintf("#$%02X", b1)
+	case zrp:
+		return fmt.Sprintf("$%02X = %02X", b1, cpu.peek8(uint16(b1)))
+	case zpx:
+		a := b1 + cpu.x
+		return fmt.Sprintf("$%02X,X @ %02X = %02X", b1, a, cpu.peek8(uint16(a)))
+	case zpy:
+		a := b1 + cpu.y
+		return fmt.Sprintf("$%02X,Y @ %02X = %02X", b1, a, cpu.peek8(uint16(a)))
+	case abs:
+		if p.mnemonic == "jmp" || p.mnemonic == "jsr" {
+			return fmt.Sprintf("$%04X", w)
+		}
+		return fmt.Sprintf("$%04X = %02X", w, cpu.peek8(w))
+	case abx:
+		a := w + uint16(cpu.x)
+		return fmt.Sprintf("$%04X,X @ %04X = %02X", w, a, cpu.peek8(a))
+	case aby:
+		a := w + uint16(cpu.y)
+		return fmt.Sprintf("$%04X,Y @ %04X = %02X", w, a, cpu.peek8(a))
+	case ind:
+		lo := cpu.peek8(w)
+		hi := cpu.peek8(w&0xff00 | uint16(uint8(w)+1))
+		return fmt.Sprintf("($%04X) = %04X", w, uint16(hi)<<8|uint16(lo))
+	case inx:
+		zp := b1 + cpu.x
+		a := cpu.peek16Zp(zp)
+		return fmt.Sprintf("($%02X,X) @ %02X = %04X = %02X", b1, zp, a, cpu.peek8(a))
+	case iny:
+		base := cpu.peek16Zp(b1)
+		a := base + uint16(cpu.y)
+		return fmt.Sprintf("($%02X),Y = %04X @ %04X = %02X", b1, base, a, cpu.peek8(a))
+	case rel:
+		return fmt.Sprintf("$%04X", uint16(int(pc+2)+int(int8(b1))))
+	}
+	return ""
+}
+
+// GetTraceLine formats the instruction at the current PC the way
+// Nintendulator writes it to nestest.log.
+func (cpu *Cpu) GetTraceLine(scanline uint, dot uint) string {
+	pc := cpu.pc
+	opc := cpu.peek8(pc)
+	p := instTable[opc]
+
+	var code []string
+	for i := uint16(0); i < uint16(p.bytes); i++ {
+		code = append(code, fmt.Sprintf("%02X", cpu.peek8(pc+i)))
+	}
+
+	mnemonic := p.mnemonic
+	if m, ok := nestestMnemonic[mnemonic]; ok && p.unofficial {
+		mnemonic = m
+	}
+	asm := strings.ToUpper(mnemonic)
+	if opd := cpu.getTraceOpdString(opc, pc); opd != "" {
+		asm += " " + opd
+	}
+
+	return fmt.Sprintf("%04X  %-9s%c%-32sA:%02X X:%02X Y:%02X P:%02X SP:%02X PPU:%3d,%3d CYC:%d",
+		pc, strings.Join(code, " "), p.marker(), asm,
+		cpu.a, cpu.x, cpu.y, cpu.p, cpu.s, scanline, dot, cpu.cycles)
+}
+
+func (dbg *Debugger) traceInst(cpu *Cpu) {
+	if dbg.traceLog != nil {
+		dbg.writeTraceLine(cpu)
+	}
+	if dbg.trace {
+		opc := cpu.bus.Read8NoTrace(cpu.pc)
+		Debug("%04X:%c%s %-10s    opc=%02Xh A:%02X X:%02X Y:%02X P:%02X SP:%02X\n",
+			cpu.pc, instTable[opc].marker(), instTable[opc].mnemonic,
+			modeOpsTable[instTable[opc].mode].getOpdString(cpu.bus, cpu.pc),
+			opc, cpu.a, cpu.x, cpu.y, cpu.p, cpu.s)
+	}
+}
+
+func (dbg *Debugger) writeTraceLine(cpu *Cpu) {
+	ppu := dbg.nes.ppu
+	line := cpu.GetTraceLine(ppu.currentScanline, ppu.dot())
+	dbg.traceLog.WriteString(line)
+	dbg.traceLog.WriteString("\n")
+	dbg.traceLine++
+
+	if dbg.traceRef == nil {
+		return
+	}
+	if !dbg.traceRef.Scan() {
+		fmt.Printf("trace: reference log ended at line %d\n", dbg.traceLine)
+		dbg.traceRef = nil
+		return
+	}
+	ref := dbg.traceRef.Text()
+	if !traceLineEqual(line, ref) {
+		fmt.Printf("trace: diverged at line %d\n", dbg.traceLine)
+		fmt.Printf("  got:  %s\n", line)
+		fmt.Printf("  want: %s\n", ref)
+		dbg.traceRef = nil
+		dbg.step = true
+	}
+}
+
+func (dbg *Debugger) closeTrace() {
+	if dbg.traceLog != nil {
+		dbg.traceLog.Flush()
+	}
+	for _, f := range dbg.traceFiles {
+		if err := f.Close(); err != nil {
+			fmt.Println(err)
+		}
+	}
+	dbg.traceLog = nil
+	dbg.traceRef = nil
+	dbg.traceFiles = nil
+}
+
+func traceLineEqual(a string, b string) bool {
+	return strings.TrimRight(a, " \r") == strings.TrimRight(b, " \r")
+}
+
+type TraceDivergence struct {
+	Line int
+	Got  string
+	Want string
+}
+
+func (d *TraceDivergence) String() string {
+	return fmt.Sprintf("line %d:\n  got:  %s\n  want: %s", d.Line, d.Got, d.Want)
+}
+
+// CompareTraceLog compares a trace log with a reference log line by line
+// and returns the first differing line, or nil if they match. A log that
+// ends early counts as a difference against an empty line.
+func CompareTraceLog(log io.Reader, ref io.Reader) (*TraceDivergence, error) {
+	ls := bufio.NewScanner(log)
+	rs := bufio.NewScanner(ref)
+	for line := 1; ; line++ {
+		lok := ls.Scan()
+		rok := rs.Scan()
+		if !lok && !rok {
+			break
+		}
+		var l, r string
+		if lok {
+			l = ls.Text()
+		}
+		if rok {
+			r = rs.Text()
+		}
+		if !lok || !rok || !traceLineEqual(l, r) {
+			return &TraceDivergence{line, l, r}, nil
+		}
+	}
+	if err := ls.Err(); err != nil {
+		return nil, err
+	}
+	return nil, rs.Err()
+}
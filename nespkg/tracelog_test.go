@@ -0,0 +1,68 @@
+package nespkg
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type nullDisplay struct{}
+
+func (d *nullDisplay) Render(screen *[ScreenSizePixY][ScreenSizePixX]uint16) {}
+
+func countLines(t *testing.T, filename string) int {
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	n := 0
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		n++
+	}
+	return n
+}
+
+// TestNestest runs nestest.nes in automation mode from $C000 and checks
+// the trace against nestest.log. The ROM and the log are not part of the
+// repository; put them in testdata to run it.
+func TestNestest(t *testing.T) {
+	rom := filepath.Join("testdata", "nestest.nes")
+	ref := filepath.Join("testdata", "nestest.log")
+	for _, name := range []string{rom, ref} {
+		if _, err := os.Stat(name); err != nil {
+			t.Skipf("%s not found", name)
+		}
+	}
+	log := filepath.Join(t.TempDir(), "trace.log")
+
+	nes := NewNes(&Conf{TraceLogFile: log, EntryPoint: 0xc000}, &nullDisplay{})
+	if err := nes.LoadRom(rom); err != nil {
+		t.Fatal(err)
+	}
+	nes.Reset()
+	for n := countLines(t, ref); n > 0; n-- {
+		nes.cpu.executeInst()
+	}
+	nes.Close()
+
+	lf, err := os.Open(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lf.Close()
+	rf, err := os.Open(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	d, err := CompareTraceLog(lf, rf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d != nil {
+		t.Errorf("trace diverged at %s", d)
+	}
+}